@@ -18,50 +18,77 @@
 
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
 
 type HintStatus struct {
 	Hint   string `json:"hint"`
 	Status string `json:"status"`
 }
 
-type CheckInfo struct {
-	ArchiveCommand                              HintStatus `json:"archive_command"`
-	ArchiveMode                                 HintStatus `json:"archive_mode"`
-	ArchiverErrors                              HintStatus `json:"archiver_errors"`
-	BackupMaximumAge                            HintStatus `json:"backup_maximum_age"`
-	BackupMinimumSize                           HintStatus `json:"backup_minimum_size"`
-	CompressionSettings                         HintStatus `json:"compression_settings"`
-	ContinuousArchiving                         HintStatus `json:"continuous_archiving"`
-	Directories                                 HintStatus `json:"directories"`
-	FailedBackups                               HintStatus `json:"failed_backups"`
-	MinimumRedundancyRequirements               HintStatus `json:"minimum_redundancy_requirements"`
-	PgReceivexlog                               HintStatus `json:"pg_receivexlog"`
-	PgReceivexlogCompatible                     HintStatus `json:"pg_receivexlog_compatible"`
-	Postgresql                                  HintStatus `json:"postgresql"`
-	PostgresqlStreaming                         HintStatus `json:"postgresql_streaming"`
-	ReceiveWalRunning                           HintStatus `json:"receive_wal_running"`
-	ReplicationSlot                             HintStatus `json:"replication_slot"`
-	RetentionPolicySettings                     HintStatus `json:"retention_policy_settings"`
-	SSH                                         HintStatus `json:"ssh"`
-	SuperuserOrStandardUserWithBackupPrivileges HintStatus `json:"superuser_or_standard_user_with_backup_privileges"`
-	SystemidCoherence                           HintStatus `json:"systemid_coherence"`
-	WalLevel                                    HintStatus `json:"wal_level"`
-	WalMaximumAge                               HintStatus `json:"wal_maximum_age"`
-	WalSize                                     HintStatus `json:"wal_size"`
+// knownChecks lists the checks reported by the barman releases this exporter was written against
+var knownChecks = map[string]bool{
+	"archive_command":                 true,
+	"archive_mode":                    true,
+	"archiver_errors":                 true,
+	"backup_maximum_age":              true,
+	"backup_minimum_size":             true,
+	"compression_settings":            true,
+	"continuous_archiving":            true,
+	"directories":                     true,
+	"failed_backups":                  true,
+	"minimum_redundancy_requirements": true,
+	"pg_receivexlog":                  true,
+	"pg_receivexlog_compatible":       true,
+	"postgresql":                      true,
+	"postgresql_streaming":            true,
+	"receive_wal_running":             true,
+	"replication_slot":                true,
+	"retention_policy_settings":       true,
+	"ssh":                             true,
+	"superuser_or_standard_user_with_backup_privileges": true,
+	"systemid_coherence": true,
+	"wal_level":          true,
+	"wal_maximum_age":    true,
+	"wal_size":           true,
 }
 
-func (c CheckInfo) AllOk() bool {
-	jsonData, err := json.Marshal(c)
-	if err != nil {
-		return false
+// CheckInfo maps every check name reported by barman to its result, so checks added by
+// newer barman releases are picked up without changes to the exporter
+type CheckInfo map[string]HintStatus
+
+// Checks returns every check result keyed by the name used by barman
+func (c CheckInfo) Checks() map[string]HintStatus {
+	return c
+}
+
+// Unknown returns the names of the checks not present in knownChecks
+func (c CheckInfo) Unknown() []string {
+	var unknown []string
+	for name := range c {
+		if !knownChecks[name] {
+			unknown = append(unknown, name)
+		}
 	}
-	var fields map[string]HintStatus
-	if err = json.Unmarshal(jsonData, &fields); err != nil {
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+func (h HintStatus) Ok() bool {
+	return h.Status == "OK"
+}
+
+func (c CheckInfo) AllOk() bool {
+	if len(c) == 0 {
 		return false
 	}
-	for field := range fields {
-		if fields[field].Status != "OK" {
+	for name := range c {
+		if !c[name].Ok() {
 			return false
 		}
 	}
@@ -160,6 +187,8 @@ type ShowBackupInfo struct {
 	Status                string             `json:"status"`
 	Tablespaces           []interface{}      `json:"tablespaces"`
 	WalInformation        WalInformation     `json:"wal_information"`
+	// XlogSegmentSize is the WAL segment size of the cluster as stored in backup.info, 0 if unknown
+	XlogSegmentSize int64 `json:"xlog_segment_size"`
 }
 
 type BarmanShowBackup map[string]ShowBackupInfo
@@ -178,3 +207,100 @@ type BackupInfo struct {
 }
 
 type BarmanListBackup map[string][]BackupInfo
+
+// ReplicationClient is a client streaming from the PostgreSQL server, a standby or a WAL
+// streamer like barman's own pg_receivewal
+type ReplicationClient struct {
+	ApplicationName string `json:"application_name"`
+	SyncStage       string `json:"sync_stage"`
+	Communication   string `json:"communication"`
+	IPAddress       string `json:"ip_address"`
+	Port            int    `json:"port"`
+	UserName        string `json:"user_name"`
+	CurrentState    string `json:"current_state"`
+	ReplicationSlot string `json:"replication_slot"`
+	WalSenderPid    int    `json:"wal_sender_pid"`
+	StartedAt       string `json:"started_at"`
+	SentLsn         string `json:"sent_lsn"`
+	WriteLsn        string `json:"write_lsn"`
+	FlushLsn        string `json:"flush_lsn"`
+	ReplayLsn       string `json:"replay_lsn"`
+	WriteLag        string `json:"write_lag"`
+	FlushLag        string `json:"flush_lag"`
+	ReplayLag       string `json:"replay_lag"`
+}
+
+// WalStreamer returns true for the clients that don't replay the WAL (pg_receivewal), barman
+// tells them apart from the standbys the same way
+func (c ReplicationClient) WalStreamer() bool {
+	return c.ReplayLsn == ""
+}
+
+// ReplicationClients is the list of clients, barman prints a message instead when there is none
+type ReplicationClients []ReplicationClient
+
+func (c *ReplicationClients) UnmarshalJSON(data []byte) error {
+	var message string
+	if err := json.Unmarshal(data, &message); err == nil {
+		*c = ReplicationClients{}
+		return nil
+	}
+
+	var clients []ReplicationClient
+	if err := json.Unmarshal(data, &clients); err != nil {
+		return err
+	}
+	*c = clients
+
+	return nil
+}
+
+type ReplicationStatusInfo struct {
+	Description string             `json:"description"`
+	CurrentLsn  string             `json:"current_lsn"`
+	Clients     ReplicationClients `json:"streaming_clients"`
+}
+
+type BarmanReplicationStatus map[string]ReplicationStatusInfo
+
+type SystemInfo struct {
+	BarmanVer string `json:"barman_ver"`
+	KernelVer string `json:"kernel_ver"`
+	PythonVer string `json:"python_ver"`
+	Release   string `json:"release"`
+	RsyncVer  string `json:"rsync_ver"`
+	SshVer    string `json:"ssh_ver"`
+	Timestamp string `json:"timestamp"`
+}
+
+type DiagnoseGlobal struct {
+	SystemInfo SystemInfo `json:"system_info"`
+}
+
+// BarmanDiagnose is the part of the barman diagnose output used by the exporter
+type BarmanDiagnose struct {
+	Global DiagnoseGlobal `json:"global"`
+}
+
+// UnmarshalJSON accepts the report as is or wrapped in the _INFO messages, as the json output
+// writer of barman prints it
+func (d *BarmanDiagnose) UnmarshalJSON(data []byte) error {
+	var wrapped struct {
+		Info []string `json:"_INFO"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err == nil && len(wrapped.Info) > 0 {
+		data = []byte(strings.Join(wrapped.Info, "\n"))
+	}
+
+	type report BarmanDiagnose
+	var diagnose report
+	if err := json.Unmarshal(data, &diagnose); err != nil {
+		return err
+	}
+	if diagnose.Global.SystemInfo.BarmanVer == "" {
+		return errors.New("no barman version in the diagnose report")
+	}
+	*d = BarmanDiagnose(diagnose)
+
+	return nil
+}
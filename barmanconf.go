@@ -0,0 +1,194 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// globalSection is the section of barman.conf holding the defaults of every server
+const globalSection = "barman"
+
+// serverConfig holds the options of a server section, merged with the global defaults
+type serverConfig map[string]string
+
+// barmanConfig is the parsed barman.conf with its included server files
+type barmanConfig struct {
+	global  map[string]string
+	servers map[string]serverConfig
+}
+
+// parseIni reads an ini file the way python's configparser does: keys are lowercase,
+// comments start with # or ; and indented lines continue the previous value
+func parseIni(r io.Reader) (map[string]map[string]string, error) {
+	sections := map[string]map[string]string{}
+	var section map[string]string
+	var lastKey string
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if raw[0] == ' ' || raw[0] == '\t' {
+			if section == nil || lastKey == "" {
+				return nil, fmt.Errorf("line %d: continuation line without an option", lineNumber)
+			}
+			section[lastKey] = strings.TrimSpace(section[lastKey] + "\n" + line)
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if sections[name] == nil {
+				sections[name] = map[string]string{}
+			}
+			section = sections[name]
+			lastKey = ""
+			continue
+		}
+
+		if section == nil {
+			return nil, fmt.Errorf("line %d: option outside of a section", lineNumber)
+		}
+		separator := strings.IndexAny(line, "=:")
+		if separator < 0 {
+			return nil, fmt.Errorf("line %d: invalid option %q", lineNumber, line)
+		}
+		lastKey = strings.ToLower(strings.TrimSpace(line[:separator]))
+		section[lastKey] = strings.TrimSpace(line[separator+1:])
+	}
+
+	return sections, scanner.Err()
+}
+
+func readIniFile(path string) (map[string]map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sections, err := parseIni(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return sections, nil
+}
+
+// loadBarmanConfig reads barman.conf and the *.conf files of its configuration_files_directory
+func loadBarmanConfig(path string) (*barmanConfig, error) {
+	sections, err := readIniFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &barmanConfig{global: sections[globalSection], servers: map[string]serverConfig{}}
+	if config.global == nil {
+		config.global = map[string]string{}
+	}
+	delete(sections, globalSection)
+
+	if dir := config.global["configuration_files_directory"]; dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			included, err := readIniFile(file)
+			if err != nil {
+				return nil, err
+			}
+			for name, options := range included {
+				if name == globalSection {
+					// barman ignores the global section of the included files
+					continue
+				}
+				if sections[name] == nil {
+					sections[name] = map[string]string{}
+				}
+				for key, value := range options {
+					sections[name][key] = value
+				}
+			}
+		}
+	}
+
+	for name, options := range sections {
+		server := serverConfig{}
+		for key, value := range config.global {
+			server[key] = value
+		}
+		for key, value := range options {
+			server[key] = value
+		}
+		config.servers[name] = server
+	}
+
+	return config, nil
+}
+
+// get returns the value of an option or its barman default
+func (c serverConfig) get(key string) string {
+	if value, ok := c[key]; ok {
+		return value
+	}
+
+	switch key {
+	case "backup_method":
+		return "rsync"
+	case "retention_policy_mode":
+		return "auto"
+	case "wal_retention_policy":
+		return "main"
+	case "streaming_archiver":
+		return "off"
+	case "archiver":
+		// barman enables the archiver when no other method to receive the WAL files is set
+		if streaming, err := parseConfigBool(c.get("streaming_archiver")); err == nil && streaming {
+			return "off"
+		}
+		return "on"
+	case "minimum_redundancy":
+		return "0"
+	}
+
+	return ""
+}
+
+// bool returns an option as "true" or "false", the value is kept as is if it isn't a boolean
+func (c serverConfig) bool(key string) string {
+	value := c.get(key)
+	if parsed, err := parseConfigBool(value); err == nil {
+		return fmt.Sprint(parsed)
+	}
+
+	return value
+}
@@ -0,0 +1,95 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIni(t *testing.T) {
+	sections, err := parseIni(strings.NewReader("# comment\n[main]\nKey = value\nlist: a\n  b\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "value", sections["main"]["key"])
+	assert.Equal(t, "a\nb", sections["main"]["list"])
+
+	_, err = parseIni(strings.NewReader("key = value\n"))
+	assert.Error(t, err)
+}
+
+func TestLoadBarmanConfig(t *testing.T) {
+	config, err := loadBarmanConfig("tests/barman.conf")
+	assert.NoError(t, err)
+	assert.Len(t, config.servers, 2)
+
+	host1 := config.servers["host1"]
+	assert.Equal(t, "rsync", host1.get("backup_method"))
+	assert.Equal(t, "1 DAYS", host1.get("last_backup_maximum_age"))
+	assert.Equal(t, "1", host1.get("minimum_redundancy"))
+	assert.Equal(t, "ssh -p 25432\npostgres@host1.dc.example.com", host1.get("ssh_command"))
+	assert.Equal(t, "true", host1.bool("archiver"))
+	assert.Equal(t, "false", host1.bool("streaming_archiver"))
+
+	host2 := config.servers["host2"]
+	assert.Equal(t, "2 DAYS", host2.get("last_backup_maximum_age"))
+	assert.Equal(t, "false", host2.bool("archiver"))
+	assert.Equal(t, "true", host2.bool("streaming_archiver"))
+
+	_, err = loadBarmanConfig("tests/missing.conf")
+	assert.Error(t, err)
+}
+
+func TestConfigMetrics(t *testing.T) {
+	options := DefaultOptions()
+	options.BarmanConfig = "tests/barman.conf"
+	exporter, r := newTestExporter(options)
+	exporter.Refresh(context.Background())
+
+	value, ok := metricValue(t, r, "barman_server_info", prometheus.Labels{
+		"server":                "host1",
+		"backup_method":         "rsync",
+		"retention_policy":      "RECOVERY WINDOW OF 3 DAYS",
+		"retention_policy_mode": "auto",
+		"wal_retention_policy":  "main",
+		"archiver":              "true",
+		"streaming_archiver":    "false",
+	})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+
+	value, ok = metricValue(t, r, "barman_config_last_backup_maximum_age_seconds", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(86400), value)
+
+	value, ok = metricValue(t, r, "barman_config_retention_recovery_window_seconds", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(3*86400), value)
+
+	value, ok = metricValue(t, r, "barman_config_minimum_redundancy", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+
+	// host2 is configured but not listed by barman
+	_, ok = metricValue(t, r, "barman_config_minimum_redundancy", prometheus.Labels{"server": "host2"})
+	assert.False(t, ok)
+}
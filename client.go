@@ -0,0 +1,232 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errNotSupported is returned by the clients for the data they can't provide
+var errNotSupported = errors.New("not supported by this client")
+
+// BarmanClient provides the output of the barman commands used by the exporter
+type BarmanClient interface {
+	ListServer(ctx context.Context) (BarmanListServer, error)
+	Check(ctx context.Context, server string) (BarmanCheck, error)
+	Status(ctx context.Context, server string) (BarmanStatus, error)
+	ListBackup(ctx context.Context, server string) (BarmanListBackup, error)
+	ShowBackup(ctx context.Context, server, id string) (BarmanShowBackup, error)
+	ReplicationStatus(ctx context.Context, server string) (BarmanReplicationStatus, error)
+	Diagnose(ctx context.Context) (BarmanDiagnose, error)
+	// CheckBackup and VerifyBackup only report through their error if the backup is restorable
+	CheckBackup(ctx context.Context, server, id string) error
+	VerifyBackup(ctx context.Context, server, id string) error
+}
+
+// fixtureName returns the file holding the output of a command, e.g. show-backup_host1_20220227T070011.json
+func fixtureName(command string, args ...string) string {
+	return strings.Join(append([]string{command}, args...), "_") + ".json"
+}
+
+// FixtureClient replays the command outputs stored in a directory, as written by a RecordingClient
+type FixtureClient struct {
+	Dir string
+}
+
+func (c FixtureClient) read(data interface{}, command string, args ...string) error {
+	content, err := ioutil.ReadFile(filepath.Join(c.Dir, fixtureName(command, args...)))
+	if err != nil {
+		return &commandError{reason: "exec", err: err}
+	}
+	if err = json.Unmarshal(content, data); err != nil {
+		return &commandError{reason: "parse", err: err}
+	}
+
+	return nil
+}
+
+func (c FixtureClient) ListServer(_ context.Context) (BarmanListServer, error) {
+	var data BarmanListServer
+	if err := c.read(&data, "list-server"); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c FixtureClient) Check(_ context.Context, server string) (BarmanCheck, error) {
+	var data BarmanCheck
+	if err := c.read(&data, "check", server); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c FixtureClient) Status(_ context.Context, server string) (BarmanStatus, error) {
+	var data BarmanStatus
+	if err := c.read(&data, "status", server); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c FixtureClient) ListBackup(_ context.Context, server string) (BarmanListBackup, error) {
+	var data BarmanListBackup
+	if err := c.read(&data, "list-backup", server); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c FixtureClient) ShowBackup(_ context.Context, server, id string) (BarmanShowBackup, error) {
+	var data BarmanShowBackup
+	if err := c.read(&data, "show-backup", server, id); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c FixtureClient) ReplicationStatus(_ context.Context, server string) (BarmanReplicationStatus, error) {
+	var data BarmanReplicationStatus
+	if err := c.read(&data, "replication-status", server); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c FixtureClient) Diagnose(_ context.Context) (BarmanDiagnose, error) {
+	var data BarmanDiagnose
+	if err := c.read(&data, "diagnose"); err != nil {
+		return BarmanDiagnose{}, err
+	}
+
+	return data, nil
+}
+
+// CheckBackup succeeds if the fixture exists, barman doesn't print anything for this command
+func (c FixtureClient) CheckBackup(_ context.Context, server, id string) error {
+	var data interface{}
+	return c.read(&data, "check-backup", server, id)
+}
+
+// VerifyBackup succeeds if the fixture exists
+func (c FixtureClient) VerifyBackup(_ context.Context, server, id string) error {
+	var data interface{}
+	return c.read(&data, "verify-backup", server, id)
+}
+
+// RecordingClient saves the successful outputs of another client in a directory so they can be
+// replayed later with a FixtureClient
+type RecordingClient struct {
+	Client BarmanClient
+	Dir    string
+}
+
+// record saves the output of a successful command, a failure to save it is only logged
+func (c RecordingClient) record(data interface{}, err error, command string, args ...string) error {
+	if err != nil {
+		return err
+	}
+	if err = c.write(data, command, args...); err != nil {
+		log.Printf("Failed to record the output of barman %s: %v", command, err)
+	}
+
+	return nil
+}
+
+// write saves the output atomically, the servers are collected concurrently
+func (c RecordingClient) write(data interface{}, command string, args ...string) error {
+	content, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the %s output: %w", command, err)
+	}
+	file, err := ioutil.TempFile(c.Dir, ".record-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err = file.Write(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filepath.Join(c.Dir, fixtureName(command, args...)))
+}
+
+func (c RecordingClient) ListServer(ctx context.Context) (BarmanListServer, error) {
+	data, err := c.Client.ListServer(ctx)
+	return data, c.record(data, err, "list-server")
+}
+
+func (c RecordingClient) Check(ctx context.Context, server string) (BarmanCheck, error) {
+	data, err := c.Client.Check(ctx, server)
+	return data, c.record(data, err, "check", server)
+}
+
+func (c RecordingClient) Status(ctx context.Context, server string) (BarmanStatus, error) {
+	data, err := c.Client.Status(ctx, server)
+	return data, c.record(data, err, "status", server)
+}
+
+func (c RecordingClient) ListBackup(ctx context.Context, server string) (BarmanListBackup, error) {
+	data, err := c.Client.ListBackup(ctx, server)
+	return data, c.record(data, err, "list-backup", server)
+}
+
+func (c RecordingClient) ShowBackup(ctx context.Context, server, id string) (BarmanShowBackup, error) {
+	data, err := c.Client.ShowBackup(ctx, server, id)
+	return data, c.record(data, err, "show-backup", server, id)
+}
+
+func (c RecordingClient) ReplicationStatus(ctx context.Context, server string) (BarmanReplicationStatus, error) {
+	data, err := c.Client.ReplicationStatus(ctx, server)
+	return data, c.record(data, err, "replication-status", server)
+}
+
+func (c RecordingClient) Diagnose(ctx context.Context) (BarmanDiagnose, error) {
+	data, err := c.Client.Diagnose(ctx)
+	return data, c.record(data, err, "diagnose")
+}
+
+func (c RecordingClient) CheckBackup(ctx context.Context, server, id string) error {
+	err := c.Client.CheckBackup(ctx, server, id)
+	return c.record(nil, err, "check-backup", server, id)
+}
+
+func (c RecordingClient) VerifyBackup(ctx context.Context, server, id string) error {
+	err := c.Client.VerifyBackup(ctx, server, id)
+	return c.record(nil, err, "verify-backup", server, id)
+}
@@ -0,0 +1,99 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecClient(t *testing.T) {
+	client := NewExecClient("barman", 0)
+	var args []string
+	client.command = func(ctx context.Context, command string, arguments ...string) *exec.Cmd {
+		args = arguments
+		return exec.CommandContext(ctx, "cat", "tests/fixtures/check_host1.json")
+	}
+
+	data, err := client.Check(context.Background(), "host1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-f", "json", "check", "host1"}, args)
+	assert.True(t, data["host1"].AllOk())
+
+	client.command = func(ctx context.Context, command string, arguments ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "echo", "not json")
+	}
+	_, err = client.Check(context.Background(), "host1")
+	assert.Equal(t, "parse", commandErrorReason(err))
+
+	client.command = func(ctx context.Context, command string, arguments ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "false")
+	}
+	_, err = client.Check(context.Background(), "host1")
+	assert.Equal(t, "exit", commandErrorReason(err))
+}
+
+func TestExecClientDiagnose(t *testing.T) {
+	client := NewExecClient("barman", 0)
+	client.command = func(ctx context.Context, command string, arguments ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "cat", "tests/fixtures/diagnose.json")
+	}
+
+	data, err := client.Diagnose(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "2.19", data.Global.SystemInfo.BarmanVer)
+
+	// a report without the barman version is a parse error, not empty versions
+	client.command = func(ctx context.Context, command string, arguments ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "echo", `{"_INFO": ["{\"global\": {}}"]}`)
+	}
+	_, err = client.Diagnose(context.Background())
+	assert.Equal(t, "parse", commandErrorReason(err))
+}
+
+func TestFixtureClient(t *testing.T) {
+	show, err := testFixtureClient.ShowBackup(context.Background(), "host1", "20220227T070011")
+	assert.NoError(t, err)
+	assert.Equal(t, "DONE", show["host1"].Status)
+
+	_, err = testFixtureClient.Check(context.Background(), "host2")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestRecordingClient(t *testing.T) {
+	dir := t.TempDir()
+	recorder := RecordingClient{Client: testFixtureClient, Dir: dir}
+
+	status, err := recorder.Status(context.Background(), "host1")
+	assert.NoError(t, err)
+	_, err = recorder.Status(context.Background(), "host2")
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "status_host2.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	replayed, err := FixtureClient{Dir: dir}.Status(context.Background(), "host1")
+	assert.NoError(t, err)
+	assert.Equal(t, status, replayed)
+}
@@ -0,0 +1,288 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// cloudCatalogTTL is how long the catalog read from the bucket is reused, the exporter runs
+// several commands per server in a collection and every listing of the bucket is billed
+const cloudCatalogTTL = time.Minute
+
+// CloudOptions configures the access to the bucket written by barman-cloud-backup
+type CloudOptions struct {
+	// URL is the destination given to barman-cloud-backup (e.g. s3://bucket/path)
+	URL string
+	// Endpoint is the S3 compatible service (e.g. http://minio:9000), AWS S3 if empty
+	Endpoint string
+	// Region of the bucket, looked up from the service if empty
+	Region string
+	// AccessKey and SecretKey authenticate the requests, the AWS environment variables, the
+	// credentials file and the instance role are used when they are empty
+	AccessKey string
+	SecretKey string
+}
+
+// CloudClient reads the catalogs written by barman-cloud-backup and barman-cloud-wal-archive
+// in an S3 compatible bucket, the layout is the same as the barman_home directory
+type CloudClient struct {
+	client *minio.Client
+	bucket string
+	// prefix is the path of the catalogs in the bucket, empty or ending with a slash
+	prefix string
+
+	mu       sync.Mutex
+	catalogs map[string]cloudCatalog
+}
+
+type cloudCatalog struct {
+	catalog *diskCatalog
+	read    time.Time
+}
+
+// NewCloudClient creates a client for the catalogs under the URL of the options
+func NewCloudClient(options CloudOptions) (*CloudClient, error) {
+	destination, err := url.Parse(options.URL)
+	if err != nil {
+		return nil, err
+	}
+	if destination.Scheme != "s3" || destination.Host == "" {
+		return nil, fmt.Errorf("invalid cloud URL %q, expected s3://bucket/path", options.URL)
+	}
+	prefix := strings.Trim(destination.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	host, secure := "s3.amazonaws.com", true
+	if options.Endpoint != "" {
+		endpoint, err := url.Parse(options.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid cloud endpoint %q, expected http(s)://host[:port]", options.Endpoint)
+		}
+		host, secure = endpoint.Host, endpoint.Scheme != "http"
+	}
+
+	creds := credentials.NewStaticV4(options.AccessKey, options.SecretKey, "")
+	if options.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+		})
+	}
+	client, err := minio.New(host, &minio.Options{Creds: creds, Secure: secure, Region: options.Region})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CloudClient{
+		client:   client,
+		bucket:   destination.Host,
+		prefix:   prefix,
+		catalogs: map[string]cloudCatalog{},
+	}, nil
+}
+
+// list returns the objects under the prefix, with recursive false the sub-directories are
+// returned with a trailing slash
+func (c *CloudClient) list(ctx context.Context, prefix string, recursive bool) ([]minio.ObjectInfo, error) {
+	var objects []minio.ObjectInfo
+	for object := range c.client.ListObjects(ctx, c.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: recursive}) {
+		if object.Err != nil {
+			return nil, &commandError{reason: "exec", err: object.Err}
+		}
+		objects = append(objects, object)
+	}
+
+	return objects, nil
+}
+
+func (c *CloudClient) ListServer(ctx context.Context) (BarmanListServer, error) {
+	objects, err := c.list(ctx, c.prefix, false)
+	if err != nil {
+		return nil, err
+	}
+
+	data := BarmanListServer{}
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, "/") {
+			data[path.Base(object.Key)] = ListInfo{}
+		}
+	}
+
+	// the catalogs of the servers removed from the bucket aren't kept
+	c.mu.Lock()
+	for server := range c.catalogs {
+		if _, ok := data[server]; !ok {
+			delete(c.catalogs, server)
+		}
+	}
+	c.mu.Unlock()
+
+	return data, nil
+}
+
+// readBackups downloads the backup.info files of the server, the backups being uploaded
+// don't have one yet
+func (c *CloudClient) readBackups(ctx context.Context, server string) ([]backupInfoFile, error) {
+	objects, err := c.list(ctx, c.prefix+server+"/base/", false)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backupInfoFile
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+		file, err := c.client.GetObject(ctx, c.bucket, object.Key+"backup.info", minio.GetObjectOptions{})
+		if err != nil {
+			return nil, &commandError{reason: "exec", err: err}
+		}
+		info, err := parseBackupInfo(file)
+		_ = file.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			continue
+		} else if err != nil {
+			return nil, &commandError{reason: "exec", err: err}
+		}
+		if info["backup_id"] == "" {
+			info["backup_id"] = path.Base(object.Key)
+		}
+		backups = append(backups, info)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i]["backup_id"] < backups[j]["backup_id"]
+	})
+
+	return backups, nil
+}
+
+// readWals lists the archived WAL files of the server, barman-cloud-wal-archive has no xlog.db
+// so the time of a file is the time it was uploaded
+func (c *CloudClient) readWals(ctx context.Context, server string) ([]walEntry, error) {
+	objects, err := c.list(ctx, c.prefix+server+"/wals/", true)
+	if err != nil {
+		return nil, err
+	}
+
+	var wals []walEntry
+	for _, object := range objects {
+		name := walSegmentName(path.Base(object.Key))
+		if name == "" {
+			continue
+		}
+		wals = append(wals, walEntry{Name: name, Size: object.Size, Time: float64(object.LastModified.Unix())})
+	}
+
+	return wals, nil
+}
+
+func (c *CloudClient) readCatalog(ctx context.Context, server string) (*diskCatalog, error) {
+	c.mu.Lock()
+	cached, ok := c.catalogs[server]
+	c.mu.Unlock()
+	if ok && time.Since(cached.read) < cloudCatalogTTL {
+		return cached.catalog, nil
+	}
+
+	backups, err := c.readBackups(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	wals, err := c.readWals(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	catalog := newCatalog(backups, wals)
+
+	c.mu.Lock()
+	c.catalogs[server] = cloudCatalog{catalog: catalog, read: time.Now()}
+	c.mu.Unlock()
+
+	return catalog, nil
+}
+
+func (c *CloudClient) Status(ctx context.Context, server string) (BarmanStatus, error) {
+	catalog, err := c.readCatalog(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+
+	return BarmanStatus{server: catalog.status()}, nil
+}
+
+func (c *CloudClient) ListBackup(ctx context.Context, server string) (BarmanListBackup, error) {
+	catalog, err := c.readCatalog(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+
+	return BarmanListBackup{server: catalog.listBackup()}, nil
+}
+
+func (c *CloudClient) ShowBackup(ctx context.Context, server, id string) (BarmanShowBackup, error) {
+	catalog, err := c.readCatalog(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+
+	show, ok := catalog.showBackup(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown backup %s of %s", id, server)
+	}
+
+	return BarmanShowBackup{server: show}, nil
+}
+
+func (c *CloudClient) Check(_ context.Context, _ string) (BarmanCheck, error) {
+	return nil, errNotSupported
+}
+
+func (c *CloudClient) CheckBackup(_ context.Context, _, _ string) error {
+	return errNotSupported
+}
+
+func (c *CloudClient) VerifyBackup(_ context.Context, _, _ string) error {
+	return errNotSupported
+}
+
+func (c *CloudClient) Diagnose(_ context.Context) (BarmanDiagnose, error) {
+	return BarmanDiagnose{}, errNotSupported
+}
+
+func (c *CloudClient) ReplicationStatus(_ context.Context, _ string) (BarmanReplicationStatus, error) {
+	return nil, errNotSupported
+}
@@ -0,0 +1,263 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type s3Object struct {
+	data     []byte
+	size     int64
+	modified time.Time
+}
+
+type s3ListResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	Delimiter      string
+	KeyCount       int
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []s3ListEntry
+	CommonPrefixes []s3ListPrefix
+}
+
+type s3ListEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3ListPrefix struct {
+	Prefix string
+}
+
+// newFakeS3 serves the ListObjectsV2 and GetObject requests of a single bucket
+func newFakeS3(t *testing.T, bucket string, objects map[string]s3Object) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/"+bucket)
+		if r.Method != http.MethodGet || !strings.HasPrefix(path, "/") {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		if key := strings.TrimPrefix(path, "/"); key != "" {
+			object, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Message>missing</Message><Key>%s</Key><BucketName>%s</BucketName></Error>", key, bucket)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+			w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+			w.Header().Set("ETag", `"etag"`)
+			_, _ = w.Write(object.data)
+			return
+		}
+
+		query := r.URL.Query()
+		result := s3ListResult{Name: bucket, Prefix: query.Get("prefix"), Delimiter: query.Get("delimiter"), MaxKeys: 1000}
+		prefixes := map[string]bool{}
+		for key, object := range objects {
+			if !strings.HasPrefix(key, result.Prefix) {
+				continue
+			}
+			if result.Delimiter != "" {
+				if i := strings.Index(key[len(result.Prefix):], result.Delimiter); i >= 0 {
+					prefixes[key[:len(result.Prefix)+i+1]] = true
+					continue
+				}
+			}
+			result.Contents = append(result.Contents, s3ListEntry{
+				Key:          key,
+				LastModified: object.modified.UTC().Format(time.RFC3339),
+				ETag:         `"etag"`,
+				Size:         object.size,
+				StorageClass: "STANDARD",
+			})
+		}
+		for prefix := range prefixes {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3ListPrefix{Prefix: prefix})
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		sort.Slice(result.CommonPrefixes, func(i, j int) bool { return result.CommonPrefixes[i].Prefix < result.CommonPrefixes[j].Prefix })
+		result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+
+		w.Header().Set("Content-Type", "application/xml")
+		assert.NoError(t, xml.NewEncoder(w).Encode(result))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// cloudObjects uploads the catalog of tests/barman_home/host1 like barman-cloud does, the WAL
+// files are modified at the time recorded in xlog.db
+func cloudObjects(t *testing.T, prefix string) map[string]s3Object {
+	objects := map[string]s3Object{}
+	infos, err := filepath.Glob("tests/barman_home/host1/base/*/backup.info")
+	assert.NoError(t, err)
+	for _, info := range infos {
+		data, err := ioutil.ReadFile(info)
+		assert.NoError(t, err)
+		id := filepath.Base(filepath.Dir(info))
+		objects[prefix+"host1/base/"+id+"/backup.info"] = s3Object{data: data, size: int64(len(data)), modified: time.Now()}
+		objects[prefix+"host1/base/"+id+"/data.tar"] = s3Object{size: 1024, modified: time.Now()}
+	}
+	// a backup being uploaded has no backup.info yet
+	objects[prefix+"host1/base/20220301T070000/data.tar"] = s3Object{size: 1024, modified: time.Now()}
+
+	file, err := os.Open("tests/barman_home/host1/wals/xlog.db")
+	assert.NoError(t, err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		size, _ := strconv.ParseInt(fields[1], 10, 64)
+		stamp, _ := strconv.ParseFloat(fields[2], 64)
+		key := prefix + "host1/wals/" + fields[0][:16] + "/" + fields[0]
+		if fields[3] == "gzip" {
+			key += ".gz"
+		}
+		objects[key] = s3Object{size: size, modified: time.Unix(int64(stamp), 0)}
+	}
+	assert.NoError(t, scanner.Err())
+
+	return objects
+}
+
+func testCloudClient(t *testing.T) (*CloudClient, string) {
+	server := newFakeS3(t, "barman", cloudObjects(t, "offsite/"))
+	client, err := NewCloudClient(CloudOptions{
+		URL:       "s3://barman/offsite",
+		Endpoint:  server.URL,
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	assert.NoError(t, err)
+
+	return client, server.URL
+}
+
+func TestNewCloudClient(t *testing.T) {
+	_, err := NewCloudClient(CloudOptions{URL: "gs://barman/offsite"})
+	assert.Error(t, err)
+	_, err = NewCloudClient(CloudOptions{URL: "s3://barman", Endpoint: "minio:9000"})
+	assert.Error(t, err)
+
+	client, err := NewCloudClient(CloudOptions{URL: "s3://barman", AccessKey: "access", SecretKey: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, "barman", client.bucket)
+	assert.Equal(t, "", client.prefix)
+	client, err = NewCloudClient(CloudOptions{URL: "s3://barman/offsite/pg/", Endpoint: "http://minio:9000"})
+	assert.NoError(t, err)
+	assert.Equal(t, "offsite/pg/", client.prefix)
+}
+
+func TestCloudCatalog(t *testing.T) {
+	client, _ := testCloudClient(t)
+	ctx := context.Background()
+
+	servers, err := client.ListServer(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, BarmanListServer{"host1": ListInfo{}}, servers)
+
+	status, err := client.Status(ctx, "host1")
+	assert.NoError(t, err)
+	info := status["host1"]
+	assert.Equal(t, "3", info.BackupsNumber.Message)
+	assert.Equal(t, "20220225T070004", info.FirstBackup.Message)
+	assert.Equal(t, "20220227T070011", info.LastBackup.Message)
+	assert.True(t, strings.HasPrefix(info.LastArchivedWal.Message, "000000010000006B000000E0, at "))
+
+	list, err := client.ListBackup(ctx, "host1")
+	assert.NoError(t, err)
+	backups := list["host1"]
+	if assert.Len(t, backups, 4) {
+		assert.Equal(t, "20220228T070002", backups[0].BackupID)
+		assert.Equal(t, "20220227T070011", backups[1].BackupID)
+		assert.Equal(t, 430*2097152, backups[1].WalSizeBytes)
+	}
+
+	show, err := client.ShowBackup(ctx, "host1", "20220227T070011")
+	assert.NoError(t, err)
+	assert.Equal(t, "000000010000006B000000E0", show["host1"].WalInformation.LastAvailable)
+	_, err = client.ShowBackup(ctx, "host1", "20220301T070000")
+	assert.Error(t, err)
+
+	_, err = client.Check(ctx, "host1")
+	assert.True(t, errors.Is(err, errNotSupported))
+
+	// the catalogs of the servers missing from the bucket are dropped
+	client.catalogs["host2"] = cloudCatalog{catalog: newCatalog(nil, nil), read: time.Now()}
+	_, err = client.ListServer(ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, client.catalogs, "host1")
+	assert.NotContains(t, client.catalogs, "host2")
+}
+
+func TestCloudService(t *testing.T) {
+	_, endpoint := testCloudClient(t)
+	config := testConfig()
+	config.Backend = "fixtures"
+	config.FixturesDir = "tests/fixtures"
+	config.CollectOnScrape = true
+	config.Cloud = CloudConfig{
+		URL:       "s3://barman/offsite",
+		Endpoint:  endpoint,
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}
+	svc := newService(func() (Config, error) { return config, nil })
+	assert.NoError(t, svc.Reload())
+	defer svc.Stop()
+
+	body := get(svc.MetricsHandler(), "/metrics").Body.String()
+	assert.Contains(t, body, `barman_up{server="host1",storage="local"} 1`)
+	assert.Contains(t, body, `barman_up{server="host1",storage="cloud"} 1`)
+	assert.Contains(t, body, `barman_backups_count{server="host1",storage="cloud"} 3`)
+	assert.Contains(t, body, `barman_last_wal_age_seconds{server="host1",storage="cloud"}`)
+	assert.Contains(t, body, `barman_last_backup_age_seconds{server="host1",storage="cloud"}`)
+	assert.Contains(t, body, `barman_backup_window_seconds{server="host1",storage="cloud"}`)
+	assert.NotContains(t, body, `barman_check_ok{server="host1",storage="cloud"`)
+
+	assert.Contains(t, get(svc.LandingHandler(), "/").Body.String(), "<h2>s3://barman/offsite</h2>")
+}
@@ -0,0 +1,269 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxUncachedShows limits the barman show-backup runs per server and collection for the backups
+// only needed by the recoverability
+const maxUncachedShows = 10
+
+// serverData holds the output of the barman commands run for a server during a collection cycle
+type serverData struct {
+	server  string
+	check   CheckInfo
+	status  *StatusInfo
+	backups []BackupInfo
+	shows   map[string]ShowBackupInfo
+	// config is the server section of barman.conf, nil if unknown
+	config serverConfig
+	// replication is the output of barman replication-status, nil if not collected
+	replication *ReplicationStatusInfo
+	// walScans are the WAL archive timelines, nil if the archive wasn't scanned
+	walScans []walTimelineScan
+	// skipped is the reason the collection of the server stopped after barman status
+	skipped string
+	// failed is set when any of the barman commands of the server failed
+	failed bool
+	// failures describes the failed commands, shown on the landing page
+	failures []string
+	// err is set when the server could not be collected at all
+	err error
+	// canceled is set when the collection was canceled before the server was collected
+	canceled bool
+}
+
+// fail marks the server as failed and logs the failure
+func (d *serverData) fail(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Printf("Failed to run %s", message)
+	d.failed = true
+	d.failures = append(d.failures, message)
+}
+
+// inactiveReason returns why a server is skipped by SkipInactive, empty if it is collected
+func inactiveReason(info StatusInfo) string {
+	if value, err := parseBool(info.Disabled.Message); err == nil && value == 1 {
+		return "disabled"
+	}
+	if value, err := parseBool(info.Active.Message); err == nil && value == 0 {
+		return "inactive"
+	}
+
+	return ""
+}
+
+func doneBackups(backupList []BackupInfo) []BackupInfo {
+	var backupEntries []BackupInfo
+	for _, entry := range backupList {
+		if entry.Status == "DONE" {
+			backupEntries = append(backupEntries, entry)
+		}
+	}
+
+	return backupEntries
+}
+
+// fetchServer runs the barman commands needed to export the metrics of a server
+func (e *Exporter) fetchServer(ctx context.Context, server string) *serverData {
+	data := &serverData{server: server, shows: map[string]ShowBackupInfo{}}
+
+	infoList, err := e.client.Status(ctx, server)
+	if err == nil {
+		info := infoList[server]
+		data.status = &info
+		if e.options.SkipInactive {
+			if data.skipped = inactiveReason(info); data.skipped != "" {
+				return data
+			}
+		}
+	} else if !errors.Is(err, errNotSupported) {
+		data.fail("barman status %s: %v", server, err)
+	}
+
+	serverCheck, err := e.client.Check(ctx, server)
+	if err == nil {
+		data.check = serverCheck[server]
+		for _, name := range data.check.Unknown() {
+			e.checkUnrecognized.With(prometheus.Labels{"server": server, "check": name}).Inc()
+		}
+	} else if !errors.Is(err, errNotSupported) {
+		data.fail("barman check %s: %v", server, err)
+	}
+
+	if e.options.Replication {
+		replication, err := e.client.ReplicationStatus(ctx, server)
+		if err == nil {
+			info := replication[server]
+			data.replication = &info
+		} else if !errors.Is(err, errNotSupported) {
+			data.fail("barman replication-status %s: %v", server, err)
+		}
+	}
+
+	if e.options.WalGaps {
+		scans, err := DiskClient{Home: e.options.BarmanHome}.ScanWals(server)
+		if err != nil {
+			data.fail("WAL archive scan of %s: %v", server, err)
+		} else {
+			data.walScans = scans
+		}
+	}
+
+	backups, err := e.client.ListBackup(ctx, server)
+	if err != nil {
+		data.fail("barman list-backup %s: %v", server, err)
+		return data
+	}
+	data.backups = backups[server]
+	if data.backups == nil {
+		data.backups = []BackupInfo{}
+	}
+
+	var backupIDs []string
+	if backupEntries := doneBackups(data.backups); len(backupEntries) > 0 {
+		backupIDs = append(backupIDs, backupEntries[0].BackupID, backupEntries[len(backupEntries)-1].BackupID)
+	}
+	if options := e.options.forServer(server); options.BackupMetrics {
+		for i, entry := range data.backups {
+			if i >= options.MaxBackups {
+				break
+			}
+			backupIDs = append(backupIDs, entry.BackupID)
+		}
+	}
+	// the age of the running backups is computed from their begin time
+	for _, entry := range data.backups {
+		if runningBackup(entry) {
+			backupIDs = append(backupIDs, entry.BackupID)
+		}
+	}
+
+	// the recoverability needs the details of every DONE backup, the ones not exported are reused
+	// from the previous collections. The cache is filled from the oldest backups, a few per
+	// collection, so a first collection of a large catalog doesn't exceed the server timeout.
+	fresh := map[string]bool{}
+	for _, backupID := range backupIDs {
+		fresh[backupID] = true
+	}
+	done := doneBackups(data.backups)
+	uncached := 0
+	for i := len(done) - 1; i > 0; i-- {
+		entry := done[i]
+		if fresh[entry.BackupID] {
+			continue
+		}
+		if show, ok := e.cachedShow(server, entry.BackupID, done[i-1].BackupID); ok {
+			data.shows[entry.BackupID] = show
+		} else if uncached < maxUncachedShows {
+			backupIDs = append(backupIDs, entry.BackupID)
+			uncached++
+		}
+	}
+
+	for _, backupID := range backupIDs {
+		if _, ok := data.shows[backupID]; ok {
+			continue
+		}
+		showList, err := e.client.ShowBackup(ctx, server, backupID)
+		if err != nil {
+			data.fail("barman show-backup %s %s: %v", server, backupID, err)
+			continue
+		}
+		show := showList[server]
+		if show.XlogSegmentSize == 0 && e.options.BarmanHome != "" {
+			// barman show-backup doesn't report the segment size, backup.info does
+			if info, err := (DiskClient{Home: e.options.BarmanHome}).readBackupInfo(server, backupID); err == nil {
+				show.XlogSegmentSize = info.int64("xlog_segment_size")
+			}
+		}
+		data.shows[backupID] = show
+	}
+	e.storeShows(server, data.shows)
+
+	return data
+}
+
+// fetchServerWithTimeout cancels the barman commands of a server after the server timeout
+func (e *Exporter) fetchServerWithTimeout(ctx context.Context, server string) *serverData {
+	if e.options.ServerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.options.ServerTimeout)
+		defer cancel()
+	}
+
+	data := e.fetchServer(ctx, server)
+	if err := ctx.Err(); err != nil {
+		return &serverData{server: server, failed: true, err: err, failures: []string{err.Error()}}
+	}
+
+	return data
+}
+
+// fetchServers collects the servers in parallel using up to Concurrency workers
+func (e *Exporter) fetchServers(ctx context.Context, servers []string) []*serverData {
+	workers := e.options.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan string)
+	results := make(chan *serverData, len(servers))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for server := range jobs {
+				data := e.fetchServerWithTimeout(ctx, server)
+				data.canceled = data.failed && ctx.Err() != nil
+				if data.err != nil {
+					log.Printf("Failed to collect server %s: %v", server, data.err)
+				}
+				results <- data
+			}
+		}()
+	}
+
+	for _, server := range servers {
+		jobs <- server
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	var collected []*serverData
+	for data := range results {
+		collected = append(collected, data)
+	}
+	sort.Slice(collected, func(i, j int) bool {
+		return collected[i].server < collected[j].server
+	})
+
+	return collected
+}
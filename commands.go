@@ -19,84 +19,296 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-var execCommand = exec.Command
-var barmanPath = "barman"
+// commandRunner runs a barman command with the json formatter and returns its output
+type commandRunner func(ctx context.Context, command string, args ...string) ([]byte, error)
 
-func barmanCheck(server string) (BarmanCheck, error) {
-	cmd := execCommand(barmanPath, "-f", "json", "check", server)
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, err
+// commandClient implements BarmanClient decoding the output of the barman commands
+type commandClient struct {
+	run commandRunner
+}
+
+type commandTimeoutKey struct{}
+
+// withCommandTimeout replaces the timeout of the clients for the commands run with the context,
+// used by the slow commands like verify-backup
+func withCommandTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, commandTimeoutKey{}, timeout)
+}
+
+// commandTimeout returns the timeout of the commands run with the context
+func commandTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if override, ok := ctx.Value(commandTimeoutKey{}).(time.Duration); ok {
+		return override
 	}
 
-	data := BarmanCheck{}
-	if err = json.Unmarshal(output, &data); err != nil {
-		return nil, err
+	return timeout
+}
+
+// ExecClient gets the data running the barman commands with the json formatter
+type ExecClient struct {
+	commandClient
+
+	// Path is the barman executable
+	Path string
+	// Timeout limits the time a single barman invocation can run, 0 to disable
+	Timeout time.Duration
+
+	// command creates the barman process, replaced by the tests
+	command func(ctx context.Context, name string, args ...string) *exec.Cmd
+}
+
+// NewExecClient creates a client running the barman executable found at path
+func NewExecClient(path string, timeout time.Duration) *ExecClient {
+	c := &ExecClient{Path: path, Timeout: timeout, command: exec.CommandContext}
+	c.commandClient = commandClient{run: c.runCommand}
+	return c
+}
+
+// runCommand runs barman with the json formatter and returns its output. The whole process
+// group is killed when the context is done so processes spawned by barman (e.g. ssh) don't
+// keep the command alive.
+func (c *ExecClient) runCommand(ctx context.Context, command string, args ...string) ([]byte, error) {
+	if timeout := commandTimeout(ctx, c.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	return data, nil
+	cmd := c.command(ctx, c.Path, append([]string{"-f", "json", command}, args...)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, &commandError{reason: "exec", err: err}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			if message := strings.TrimSpace(stderr.String()); message != "" {
+				err = fmt.Errorf("%w: %s", err, message)
+			}
+			return nil, &commandError{reason: "exit", err: err}
+		}
+		return stdout.Bytes(), nil
+	case <-ctx.Done():
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &commandError{reason: "timeout", err: ctx.Err()}
+		}
+		return nil, &commandError{reason: "canceled", err: ctx.Err()}
+	}
+}
+
+// commandError keeps the reason a barman command failed for the error metrics
+type commandError struct {
+	reason string
+	err    error
+}
+
+func (e *commandError) Error() string {
+	return e.err.Error()
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// commandErrorReason returns the reason label of a failed barman command
+func commandErrorReason(err error) string {
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.reason
+	}
+
+	return "exec"
 }
 
-func barmanListServer() (BarmanListServer, error) {
-	cmd := execCommand(barmanPath, "-f", "json", "list-server")
-	output, err := cmd.Output()
+// observedClient wraps the client of an exporter, recording the duration and the failures of
+// every barman command
+type observedClient struct {
+	client   BarmanClient
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	timeouts *prometheus.CounterVec
+}
+
+// observe records a command that started at start and returned err, the commands the client
+// doesn't support aren't recorded
+func (c observedClient) observe(command, server string, start time.Time, err error) error {
+	if errors.Is(err, errNotSupported) {
+		return err
+	}
+	labels := prometheus.Labels{"command": command, "server": server}
+	c.duration.With(labels).Observe(time.Since(start).Seconds())
+
 	if err != nil {
-		return nil, err
+		reason := commandErrorReason(err)
+		if reason == "timeout" {
+			c.timeouts.With(prometheus.Labels{"command": command}).Inc()
+		}
+		labels["reason"] = reason
+		c.errors.With(labels).Inc()
 	}
 
-	data := BarmanListServer{}
-	if err = json.Unmarshal(output, &data); err != nil {
+	return err
+}
+
+func (c observedClient) ListServer(ctx context.Context) (BarmanListServer, error) {
+	start := time.Now()
+	data, err := c.client.ListServer(ctx)
+	return data, c.observe("list-server", "", start, err)
+}
+
+func (c observedClient) Check(ctx context.Context, server string) (BarmanCheck, error) {
+	start := time.Now()
+	data, err := c.client.Check(ctx, server)
+	return data, c.observe("check", server, start, err)
+}
+
+func (c observedClient) Status(ctx context.Context, server string) (BarmanStatus, error) {
+	start := time.Now()
+	data, err := c.client.Status(ctx, server)
+	return data, c.observe("status", server, start, err)
+}
+
+func (c observedClient) ListBackup(ctx context.Context, server string) (BarmanListBackup, error) {
+	start := time.Now()
+	data, err := c.client.ListBackup(ctx, server)
+	return data, c.observe("list-backup", server, start, err)
+}
+
+func (c observedClient) ShowBackup(ctx context.Context, server, id string) (BarmanShowBackup, error) {
+	start := time.Now()
+	data, err := c.client.ShowBackup(ctx, server, id)
+	return data, c.observe("show-backup", server, start, err)
+}
+
+func (c observedClient) ReplicationStatus(ctx context.Context, server string) (BarmanReplicationStatus, error) {
+	start := time.Now()
+	data, err := c.client.ReplicationStatus(ctx, server)
+	return data, c.observe("replication-status", server, start, err)
+}
+
+func (c observedClient) Diagnose(ctx context.Context) (BarmanDiagnose, error) {
+	start := time.Now()
+	data, err := c.client.Diagnose(ctx)
+	return data, c.observe("diagnose", "", start, err)
+}
+
+func (c observedClient) CheckBackup(ctx context.Context, server, id string) error {
+	start := time.Now()
+	return c.observe("check-backup", server, start, c.client.CheckBackup(ctx, server, id))
+}
+
+func (c observedClient) VerifyBackup(ctx context.Context, server, id string) error {
+	start := time.Now()
+	return c.observe("verify-backup", server, start, c.client.VerifyBackup(ctx, server, id))
+}
+
+// runJSON runs a barman command and decodes its output into data
+func (c commandClient) runJSON(ctx context.Context, data interface{}, command string, args ...string) error {
+	output, err := c.run(ctx, command, args...)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(output, data); err != nil {
+		return &commandError{reason: "parse", err: err}
+	}
+
+	return nil
+}
+
+func (c commandClient) Check(ctx context.Context, server string) (BarmanCheck, error) {
+	data := BarmanCheck{}
+	if err := c.runJSON(ctx, &data, "check", server); err != nil {
 		return nil, err
 	}
 
 	return data, nil
 }
 
-func barmanListBackup(server string) (BarmanListBackup, error) {
-	cmd := execCommand(barmanPath, "-f", "json", "list-backup", server)
-	output, err := cmd.Output()
-	if err != nil {
+func (c commandClient) ListServer(ctx context.Context) (BarmanListServer, error) {
+	data := BarmanListServer{}
+	if err := c.runJSON(ctx, &data, "list-server"); err != nil {
 		return nil, err
 	}
 
+	return data, nil
+}
+
+func (c commandClient) ListBackup(ctx context.Context, server string) (BarmanListBackup, error) {
 	data := BarmanListBackup{}
-	if err = json.Unmarshal(output, &data); err != nil {
+	if err := c.runJSON(ctx, &data, "list-backup", server); err != nil {
 		return nil, err
 	}
 
 	return data, nil
 }
 
-func barmanStatus(server string) (BarmanStatus, error) {
-	cmd := execCommand(barmanPath, "-f", "json", "status", server)
-	result, err := cmd.Output()
-	if err != nil {
+func (c commandClient) Status(ctx context.Context, server string) (BarmanStatus, error) {
+	var data BarmanStatus
+	if err := c.runJSON(ctx, &data, "status", server); err != nil {
 		return nil, err
 	}
 
-	var data BarmanStatus
-	if err = json.Unmarshal(result, &data); err != nil {
+	return data, nil
+}
+
+func (c commandClient) ShowBackup(ctx context.Context, server, id string) (BarmanShowBackup, error) {
+	var data BarmanShowBackup
+	if err := c.runJSON(ctx, &data, "show-backup", server, id); err != nil {
 		return nil, err
 	}
 
 	return data, nil
 }
 
-func barmanShowBackup(server, id string) (BarmanShowBackup, error) {
-	cmd := execCommand(barmanPath, "-f", "json", "show-backup", server, id)
-	result, err := cmd.Output()
-	if err != nil {
+func (c commandClient) ReplicationStatus(ctx context.Context, server string) (BarmanReplicationStatus, error) {
+	var data BarmanReplicationStatus
+	if err := c.runJSON(ctx, &data, "replication-status", server); err != nil {
 		return nil, err
 	}
 
-	var data BarmanShowBackup
-	if err = json.Unmarshal(result, &data); err != nil {
-		return nil, err
+	return data, nil
+}
+
+func (c commandClient) Diagnose(ctx context.Context) (BarmanDiagnose, error) {
+	var data BarmanDiagnose
+	if err := c.runJSON(ctx, &data, "diagnose"); err != nil {
+		return BarmanDiagnose{}, err
 	}
 
 	return data, nil
 }
+
+func (c commandClient) CheckBackup(ctx context.Context, server, id string) error {
+	_, err := c.run(ctx, "check-backup", server, id)
+	return err
+}
+
+func (c commandClient) VerifyBackup(ctx context.Context, server, id string) error {
+	_, err := c.run(ctx, "verify-backup", server, id)
+	return err
+}
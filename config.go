@@ -0,0 +1,253 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds every setting of the exporter. It is filled from the command line flags and
+// then from the file given with --config.file, whose values take precedence.
+type Config struct {
+	Listen             string        `yaml:"listen"`
+	WebConfigFile      string        `yaml:"web_config_file"`
+	MetricsPath        string        `yaml:"metrics_path"`
+	Interval           time.Duration `yaml:"interval"`
+	CollectOnScrape    bool          `yaml:"collect_on_scrape"`
+	MinRefreshInterval time.Duration `yaml:"min_refresh_interval"`
+	Concurrency        int           `yaml:"concurrency"`
+	ServerTimeout      time.Duration `yaml:"server_timeout"`
+	ScrapeTimeout      time.Duration `yaml:"scrape_timeout"`
+	CommandTimeout     time.Duration `yaml:"command_timeout"`
+	DiagnoseInterval   time.Duration `yaml:"diagnose_interval"`
+	VerifyInterval     time.Duration `yaml:"verify_interval"`
+	VerifyTimeout      time.Duration `yaml:"verify_timeout"`
+	VerifyStateFile    string        `yaml:"verify_state_file"`
+	VerifyExisting     bool          `yaml:"verify_existing"`
+
+	Backend      string `yaml:"backend"`
+	BarmanPath   string `yaml:"barman_path"`
+	BarmanHome   string `yaml:"barman_home"`
+	BarmanConfig string `yaml:"barman_config"`
+	FixturesDir  string `yaml:"fixtures_dir"`
+	RecordDir    string `yaml:"record_dir"`
+
+	SSH   SSHConfig   `yaml:"ssh"`
+	Cloud CloudConfig `yaml:"cloud"`
+
+	ServerInclude string `yaml:"server_include"`
+	ServerExclude string `yaml:"server_exclude"`
+	SkipInactive  bool   `yaml:"skip_inactive"`
+
+	Metrics MetricsConfig `yaml:"metrics"`
+
+	// Servers overrides the settings of single servers
+	Servers map[string]ServerConfig `yaml:"servers"`
+}
+
+// SSHConfig configures the remote barman hosts
+type SSHConfig struct {
+	Hosts          []string      `yaml:"hosts"`
+	User           string        `yaml:"user"`
+	Keys           []string      `yaml:"keys"`
+	KnownHosts     string        `yaml:"known_hosts"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// ProbeAnyHost lets /probe connect to hosts missing from Hosts
+	ProbeAnyHost bool `yaml:"probe_any_host"`
+}
+
+// CloudConfig configures the catalogs of barman-cloud-backup exported with storage="cloud"
+type CloudConfig struct {
+	URL       string `yaml:"url"`
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+// MetricsConfig enables the optional metric groups
+type MetricsConfig struct {
+	CheckHints    bool `yaml:"check_hints"`
+	BackupMetrics bool `yaml:"backups"`
+	MaxBackups    int  `yaml:"max_backups"`
+	WalGaps       bool `yaml:"wal_gaps"`
+	Replication   bool `yaml:"replication"`
+}
+
+// ServerConfig overrides the settings of a server, the unset values keep the global ones
+type ServerConfig struct {
+	CheckHints    *bool `yaml:"check_hints"`
+	BackupMetrics *bool `yaml:"backups"`
+	MaxBackups    *int  `yaml:"max_backups"`
+	// Settings replace the options of the server in barman.conf (e.g. last_backup_maximum_age)
+	Settings map[string]string `yaml:"settings"`
+}
+
+var backends = map[string]bool{"exec": true, "disk": true, "fixtures": true}
+
+// loadConfigFile reads the YAML file over the settings of config, unknown keys are rejected
+func loadConfigFile(path string, config Config) (Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err = yaml.UnmarshalStrict(content, &config); err != nil {
+		return config, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return config, config.Validate()
+}
+
+// Validate checks the settings before they are applied
+func (c Config) Validate() error {
+	var errs []string
+	if c.Listen == "" {
+		errs = append(errs, "listen is required")
+	}
+	if c.WebConfigFile != "" {
+		if err := web.Validate(c.WebConfigFile); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid web_config_file: %v", err))
+		}
+	}
+	if c.MetricsPath == "" || c.MetricsPath[0] != '/' {
+		errs = append(errs, "metrics_path must start with /")
+	}
+	if c.Interval <= 0 && !c.CollectOnScrape {
+		errs = append(errs, "interval must be positive")
+	}
+	if c.Concurrency < 1 {
+		errs = append(errs, "concurrency must be at least 1")
+	}
+	if c.Metrics.MaxBackups < 0 {
+		errs = append(errs, "metrics.max_backups can't be negative")
+	}
+	if !backends[c.Backend] {
+		errs = append(errs, fmt.Sprintf("unknown backend %q", c.Backend))
+	}
+	if c.Backend == "fixtures" && c.FixturesDir == "" {
+		errs = append(errs, "fixtures_dir is required by the fixtures backend")
+	}
+	for name, expr := range map[string]string{"server_include": c.ServerInclude, "server_exclude": c.ServerExclude} {
+		if _, err := compileServerFilter(expr); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid %s: %v", name, err))
+		}
+	}
+	if c.Cloud.URL != "" && !strings.HasPrefix(c.Cloud.URL, "s3://") {
+		errs = append(errs, "cloud.url must start with s3://")
+	}
+	hosts := map[string]bool{}
+	for _, host := range c.SSH.Hosts {
+		// the exporters of a host are told apart by the barman_host label only
+		if name := sshHostName(host); hosts[name] {
+			errs = append(errs, fmt.Sprintf("ssh.hosts lists %s more than once", name))
+		} else {
+			hosts[name] = true
+		}
+	}
+	for server, override := range c.Servers {
+		if override.MaxBackups != nil && *override.MaxBackups < 0 {
+			errs = append(errs, fmt.Sprintf("servers.%s.max_backups can't be negative", server))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Options returns the options of the exporters
+func (c Config) Options() Options {
+	options := Options{
+		CheckHints:       c.Metrics.CheckHints,
+		BackupMetrics:    c.Metrics.BackupMetrics,
+		MaxBackups:       c.Metrics.MaxBackups,
+		Concurrency:      c.Concurrency,
+		ServerTimeout:    c.ServerTimeout,
+		ScrapeTimeout:    c.ScrapeTimeout,
+		OnScrape:         c.CollectOnScrape,
+		MinInterval:      c.MinRefreshInterval,
+		BarmanConfig:     c.BarmanConfig,
+		SkipInactive:     c.SkipInactive,
+		DiagnoseInterval: c.DiagnoseInterval,
+		VerifyTimeout:    c.VerifyTimeout,
+		VerifyStateFile:  c.VerifyStateFile,
+		VerifyExisting:   c.VerifyExisting,
+		WalGaps:          c.Metrics.WalGaps,
+		Replication:      c.Metrics.Replication,
+		BarmanHome:       c.BarmanHome,
+	}
+	// the filters were checked by Validate
+	if c.ServerInclude != "" {
+		options.ServerInclude, _ = compileServerFilter(c.ServerInclude)
+	}
+	if c.ServerExclude != "" {
+		options.ServerExclude, _ = compileServerFilter(c.ServerExclude)
+	}
+	options.Servers = c.Servers
+
+	return options
+}
+
+// SSHOptions returns the options of the connections to the remote hosts
+func (c Config) SSHOptions() SSHOptions {
+	return SSHOptions{
+		User:           c.SSH.User,
+		KeyFiles:       c.SSH.Keys,
+		KnownHostsFile: c.SSH.KnownHosts,
+		ConnectTimeout: c.SSH.ConnectTimeout,
+	}
+}
+
+// CloudOptions returns the options of the cloud catalogs
+func (c Config) CloudOptions() CloudOptions {
+	return CloudOptions{
+		URL:       c.Cloud.URL,
+		Endpoint:  c.Cloud.Endpoint,
+		Region:    c.Cloud.Region,
+		AccessKey: c.Cloud.AccessKey,
+		SecretKey: c.Cloud.SecretKey,
+	}
+}
+
+// LocalClient creates the client of the local barman installation
+func (c Config) LocalClient() BarmanClient {
+	var client BarmanClient
+	switch c.Backend {
+	case "disk":
+		client = DiskClient{Home: c.BarmanHome}
+	case "fixtures":
+		client = FixtureClient{Dir: c.FixturesDir}
+	default:
+		client = NewExecClient(c.BarmanPath, c.CommandTimeout)
+	}
+	if c.RecordDir != "" {
+		client = RecordingClient{Client: client, Dir: c.RecordDir}
+	}
+
+	return client
+}
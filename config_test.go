@@ -0,0 +1,176 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// testConfig returns the configuration of the default flags
+func testConfig() Config {
+	return Config{
+		Listen:             ":8000",
+		MetricsPath:        "/metrics",
+		Interval:           5 * time.Minute,
+		MinRefreshInterval: time.Minute,
+		Concurrency:        4,
+		ServerTimeout:      2 * time.Minute,
+		CommandTimeout:     time.Minute,
+		Backend:            "exec",
+		BarmanPath:         "barman",
+		Metrics:            MetricsConfig{MaxBackups: 10},
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	config, err := loadConfigFile("tests/config.yml", testConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, ":9000", config.Listen)
+	assert.Equal(t, "/metrics", config.MetricsPath)
+	assert.Equal(t, 10*time.Minute, config.Interval)
+	assert.Equal(t, "fixtures", config.Backend)
+	assert.Equal(t, 5, config.Metrics.MaxBackups)
+
+	options := config.Options().forServer("host1")
+	assert.True(t, options.CheckHints)
+	assert.True(t, options.BackupMetrics)
+	assert.Equal(t, 2, options.MaxBackups)
+	assert.False(t, config.Options().forServer("host2").BackupMetrics)
+	assert.False(t, config.Options().included("test-1"))
+}
+
+func TestInvalidConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"unknown key":    "listen_address: :9000\n",
+		"bad backend":    "backend: cloud\n",
+		"bad filter":     "server_include: \"host[\"\n",
+		"bad duration":   "interval: often\n",
+		"negative value": "servers:\n  host1:\n    max_backups: -1\n",
+		"bad cloud url":  "cloud:\n  url: https://bucket/path\n",
+		"duplicate host": "ssh:\n  hosts: [backup1, barman@backup1]\n",
+	}
+	for name, content := range tests {
+		path := filepath.Join(dir, "config.yml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		_, err := loadConfigFile(path, testConfig())
+		assert.Error(t, err, name)
+	}
+}
+
+func TestServerSettings(t *testing.T) {
+	config, err := loadConfigFile("tests/config.yml", testConfig())
+	assert.NoError(t, err)
+	exporter, r := newTestExporter(config.Options())
+	exporter.Refresh(context.Background())
+
+	value, ok := metricValue(t, r, "barman_config_last_backup_maximum_age_seconds", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(3*86400), value)
+	assert.Equal(t, 2, testutil.CollectAndCount(exporter, "barman_backup_size_bytes"))
+}
+
+func TestRemoteOptions(t *testing.T) {
+	options := DefaultOptions()
+	options.BarmanConfig = "/etc/barman.conf"
+	options.BarmanHome = "/var/lib/barman"
+	options.WalGaps = true
+	remote := options.remote()
+	assert.Equal(t, "", remote.BarmanConfig)
+	assert.Equal(t, "", remote.BarmanHome)
+	assert.False(t, remote.WalGaps)
+	assert.Equal(t, "/etc/barman.conf", options.BarmanConfig)
+}
+
+func TestBuildDuplicateHosts(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	assert.NoError(t, ioutil.WriteFile(knownHosts, nil, 0600))
+	config := testConfig()
+	config.SSH = SSHConfig{Hosts: []string{"backup1", "barman@backup1"}, KnownHosts: knownHosts}
+	assert.Error(t, config.Validate())
+
+	// the registration error is returned instead of panicking
+	_, err := build(config)
+	assert.Error(t, err)
+}
+
+func TestBuildRemoteTargets(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	assert.NoError(t, ioutil.WriteFile(knownHosts, nil, 0600))
+	config := testConfig()
+	config.SSH = SSHConfig{Hosts: []string{"barman@backup1"}, KnownHosts: knownHosts}
+	state, err := build(config)
+	assert.NoError(t, err)
+	defer state.targets.close()
+
+	// the probes find the hosts by their barman_host label
+	client, release, err := state.targets.client("backup1")
+	assert.NoError(t, err)
+	assert.Equal(t, "backup1", client.(*SSHClient).Host())
+	release()
+	assert.Nil(t, state.targets.newRemote)
+}
+
+func TestReload(t *testing.T) {
+	config := testConfig()
+	config.Backend = "fixtures"
+	config.FixturesDir = "tests/fixtures"
+	config.CollectOnScrape = true
+	var loadErr error
+	svc := newService(func() (Config, error) { return config, loadErr })
+	assert.NoError(t, svc.Reload())
+	defer svc.Stop()
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		svc.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return recorder.Body.String()
+	}
+	assert.Contains(t, scrape(), `barman_up{server="host1"} 1`)
+
+	config.ServerExclude = "host1"
+	recorder := httptest.NewRecorder()
+	svc.ReloadHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, scrape(), `server="host1"`)
+
+	// an invalid configuration keeps the running one
+	loadErr = errors.New("invalid configuration")
+	recorder = httptest.NewRecorder()
+	svc.ReloadHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, "host1", svc.Config().ServerExclude)
+
+	recorder = httptest.NewRecorder()
+	svc.ReloadHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.True(t, strings.Contains(recorder.Header().Get("Allow"), "POST"))
+}
@@ -0,0 +1,83 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+)
+
+var versionRegexp = regexp.MustCompile(`[0-9]+(?:\.[0-9]+)+[^\s,]*`)
+
+// barmanVersions are the versions of barman and of the tools it runs, read from barman diagnose
+type barmanVersions struct {
+	barman string
+	python string
+	rsync  string
+	ssh    string
+	kernel string
+}
+
+// extractVersion returns the first version number of a tool banner (e.g. "Python 3.9.2")
+func extractVersion(banner string) string {
+	if version := versionRegexp.FindString(banner); version != "" {
+		return version
+	}
+
+	return banner
+}
+
+func newBarmanVersions(info SystemInfo) *barmanVersions {
+	return &barmanVersions{
+		barman: info.BarmanVer,
+		python: extractVersion(info.PythonVer),
+		rsync:  extractVersion(info.RsyncVer),
+		ssh:    extractVersion(info.SshVer),
+		kernel: extractVersion(info.KernelVer),
+	}
+}
+
+// refreshDiagnose runs barman diagnose when the versions are older than DiagnoseInterval, the
+// command is slow as it inspects every server so it isn't run on every collection
+func (e *Exporter) refreshDiagnose(ctx context.Context) {
+	if e.options.DiagnoseInterval <= 0 {
+		return
+	}
+	now := e.clock.Now()
+	if !e.diagnosedAt.IsZero() && now.Sub(e.diagnosedAt) < e.options.DiagnoseInterval {
+		return
+	}
+
+	diagnose, err := e.client.Diagnose(ctx)
+	if errors.Is(err, errNotSupported) {
+		e.diagnosedAt = now
+		return
+	} else if err != nil {
+		// retried on the next collection, the previous versions are kept
+		log.Printf("Failed to run barman diagnose: %v", err)
+		return
+	}
+	e.diagnosedAt = now
+
+	e.mu.Lock()
+	e.versions = newBarmanVersions(diagnose.Global.SystemInfo)
+	e.mu.Unlock()
+}
@@ -0,0 +1,509 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	backupInfoTimeLayout = "2006-01-02 15:04:05-07:00"
+	ctimeLayout          = "Mon Jan 2 15:04:05 2006"
+)
+
+var (
+	copyStatRegexp  = regexp.MustCompile(`'(\w+)': ([0-9.]+)`)
+	errorFileRegexp = regexp.MustCompile(`^(\S+)\.([0-9]{8}T[0-9]{6})\.\w+$`)
+)
+
+// backupInfoFile holds the key/value pairs of a backup.info file written by barman
+type backupInfoFile map[string]string
+
+// parseBackupInfo reads a backup.info file, python values (None, quoted strings) are unwrapped
+func parseBackupInfo(r io.Reader) (backupInfoFile, error) {
+	info := backupInfoFile{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := parts[1]
+		if value == "None" {
+			value = ""
+		} else if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		info[parts[0]] = value
+	}
+
+	return info, scanner.Err()
+}
+
+func (b backupInfoFile) int64(key string) int64 {
+	value, _ := strconv.ParseInt(b[key], 10, 64)
+	return value
+}
+
+func (b backupInfoFile) time(key string) (time.Time, bool) {
+	value, err := time.Parse(backupInfoTimeLayout, b[key])
+	return value, err == nil
+}
+
+// copyStats returns the numeric values of the copy_stats python dictionary
+func (b backupInfoFile) copyStats() map[string]float64 {
+	stats := map[string]float64{}
+	for _, match := range copyStatRegexp.FindAllStringSubmatch(b["copy_stats"], -1) {
+		if value, err := strconv.ParseFloat(match[2], 64); err == nil {
+			stats[match[1]] = value
+		}
+	}
+
+	return stats
+}
+
+// formatSize prints a size the same way barman does (e.g. "35.7 GiB")
+func formatSize(size float64) string {
+	for _, unit := range []string{"", "Ki", "Mi", "Gi", "Ti", "Pi", "Ei"} {
+		if math.Abs(size) < 1024 {
+			return fmt.Sprintf("%.1f %sB", size, unit)
+		}
+		size /= 1024
+	}
+
+	return fmt.Sprintf("%.1f ZiB", size)
+}
+
+func formatTimestamp(t time.Time) (string, string) {
+	return t.Format(ctimeLayout), strconv.FormatInt(t.Unix(), 10)
+}
+
+// DiskClient reads the barman catalog directly from the barman_home directory, the checks are
+// not supported as they need a connection to PostgreSQL
+type DiskClient struct {
+	Home string
+}
+
+// diskCatalog is the state of a server read from the files of barman, on disk or in the cloud
+type diskCatalog struct {
+	// backups are ordered from the oldest to the newest
+	backups []backupInfoFile
+	wals    []walEntry
+}
+
+func (d DiskClient) serverDir(server string) string {
+	return filepath.Join(d.Home, server)
+}
+
+func (d DiskClient) ListServer(_ context.Context) (BarmanListServer, error) {
+	entries, err := ioutil.ReadDir(d.Home)
+	if err != nil {
+		return nil, err
+	}
+
+	data := BarmanListServer{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(d.Home, entry.Name(), "base")); err == nil && info.IsDir() {
+			data[entry.Name()] = ListInfo{}
+		}
+	}
+
+	return data, nil
+}
+
+func (d DiskClient) Check(_ context.Context, _ string) (BarmanCheck, error) {
+	return nil, errNotSupported
+}
+
+func (d DiskClient) CheckBackup(_ context.Context, _, _ string) error {
+	return errNotSupported
+}
+
+func (d DiskClient) VerifyBackup(_ context.Context, _, _ string) error {
+	return errNotSupported
+}
+
+func (d DiskClient) Diagnose(_ context.Context) (BarmanDiagnose, error) {
+	return BarmanDiagnose{}, errNotSupported
+}
+
+func (d DiskClient) ReplicationStatus(_ context.Context, _ string) (BarmanReplicationStatus, error) {
+	return nil, errNotSupported
+}
+
+// readBackupInfo parses the backup.info of a backup, for the fields barman show-backup doesn't
+// report
+func (d DiskClient) readBackupInfo(server, id string) (backupInfoFile, error) {
+	file, err := os.Open(filepath.Join(d.serverDir(server), "base", id, "backup.info"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseBackupInfo(file)
+}
+
+// readBackups parses the backup.info files of the server, ordered from the oldest to the newest
+func (d DiskClient) readBackups(server string) ([]backupInfoFile, error) {
+	baseDir := filepath.Join(d.serverDir(server), "base")
+	entries, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backupInfoFile
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		file, err := os.Open(filepath.Join(baseDir, entry.Name(), "backup.info"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		info, err := parseBackupInfo(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse backup.info of %s: %w", entry.Name(), err)
+		}
+		if info["backup_id"] == "" {
+			info["backup_id"] = entry.Name()
+		}
+		backups = append(backups, info)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i]["backup_id"] < backups[j]["backup_id"]
+	})
+
+	return backups, nil
+}
+
+// newCatalog builds the catalog of a server, the backups must be ordered from the oldest to the newest
+func newCatalog(backups []backupInfoFile, wals []walEntry) *diskCatalog {
+	catalog := &diskCatalog{backups: backups}
+	for _, wal := range wals {
+		if isWalSegment(wal.Name) {
+			catalog.wals = append(catalog.wals, wal)
+		}
+	}
+	sort.Slice(catalog.wals, func(i, j int) bool {
+		return catalog.wals[i].Name < catalog.wals[j].Name
+	})
+
+	return catalog
+}
+
+func (d DiskClient) readCatalog(server string) (*diskCatalog, error) {
+	backups, err := d.readBackups(server)
+	if err != nil {
+		return nil, err
+	}
+	wals, err := readXlogDB(filepath.Join(d.serverDir(server), "wals", "xlog.db"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return newCatalog(backups, wals), nil
+}
+
+// walStats sums the WAL files in the (from, to] range, an empty to means no upper limit
+func (c *diskCatalog) walStats(from, to string) (int64, int, string) {
+	var size int64
+	var count int
+	var last string
+	for _, wal := range c.wals {
+		if wal.Name <= from || (to != "" && wal.Name > to) {
+			continue
+		}
+		size += wal.Size
+		count++
+		last = wal.Name
+	}
+
+	return size, count, last
+}
+
+// requiredWalSize sums the WAL files needed to make the backup consistent
+func (c *diskCatalog) requiredWalSize(info backupInfoFile) int64 {
+	var size int64
+	for _, wal := range c.wals {
+		if wal.Name >= info["begin_wal"] && wal.Name <= info["end_wal"] {
+			size += wal.Size
+		}
+	}
+
+	return size
+}
+
+func (c *diskCatalog) find(backupID string) int {
+	for i, info := range c.backups {
+		if info["backup_id"] == backupID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// nextDone returns the first DONE backup after the given position, nil if there is none
+func (c *diskCatalog) nextDone(index int) backupInfoFile {
+	for _, info := range c.backups[index+1:] {
+		if info["status"] == "DONE" {
+			return info
+		}
+	}
+
+	return nil
+}
+
+func (c *diskCatalog) walsAfter(index int) (int64, int, string) {
+	info := c.backups[index]
+	if info["status"] != "DONE" {
+		return 0, 0, ""
+	}
+	next := c.nextDone(index)
+	if next == nil {
+		return c.walStats(info["end_wal"], "")
+	}
+
+	return c.walStats(info["end_wal"], next["end_wal"])
+}
+
+func (d DiskClient) Status(_ context.Context, server string) (BarmanStatus, error) {
+	catalog, err := d.readCatalog(server)
+	if err != nil {
+		return nil, err
+	}
+
+	info := catalog.status()
+	failed, err := d.failedCount(server)
+	if err != nil {
+		return nil, err
+	}
+	info.FailedCount.Message = failed
+
+	return BarmanStatus{server: info}, nil
+}
+
+// status builds the part of barman status that can be computed from the catalog
+func (c *diskCatalog) status() StatusInfo {
+	info := StatusInfo{}
+	var done []string
+	var totalSize int64
+	for _, backup := range c.backups {
+		if backup["status"] == "DONE" {
+			done = append(done, backup["backup_id"])
+			totalSize += backup.int64("size")
+		}
+	}
+	for _, wal := range c.wals {
+		totalSize += wal.Size
+	}
+
+	info.BackupsNumber.Message = strconv.Itoa(len(done))
+	info.CurrentSize.Message = formatSize(float64(totalSize))
+	if len(done) > 0 {
+		info.FirstBackup.Message = done[0]
+		info.LastBackup.Message = done[len(done)-1]
+	}
+	if len(c.wals) > 0 {
+		last := c.wals[len(c.wals)-1]
+		// convertDateToTimestamp reads the time as UTC
+		walTime := time.Unix(int64(last.Time), 0).UTC()
+		info.LastArchivedWal.Message = fmt.Sprintf("%s, at %s", last.Name, walTime.Format(ctimeLayout))
+	}
+
+	return info
+}
+
+// failedCount reports the WAL files moved by barman to the errors directory, as the archiver
+// failures of PostgreSQL can't be read from disk
+func (d DiskClient) failedCount(server string) (string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(d.serverDir(server), "errors"))
+	if os.IsNotExist(err) {
+		return "0", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	var count int
+	var lastName string
+	var lastTime time.Time
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		count++
+		matches := errorFileRegexp.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			continue
+		}
+		stamp, err := time.Parse("20060102T150405", matches[2])
+		if err == nil && stamp.After(lastTime) {
+			lastName, lastTime = matches[1], stamp
+		}
+	}
+
+	if lastName == "" {
+		return strconv.Itoa(count), nil
+	}
+
+	return fmt.Sprintf("%d (%s at %s)", count, lastName, lastTime.Format(ctimeLayout)), nil
+}
+
+func (d DiskClient) ListBackup(_ context.Context, server string) (BarmanListBackup, error) {
+	catalog, err := d.readCatalog(server)
+	if err != nil {
+		return nil, err
+	}
+
+	return BarmanListBackup{server: catalog.listBackup()}, nil
+}
+
+// listBackup lists the backups from the newest to the oldest like barman list-backup
+func (c *diskCatalog) listBackup() []BackupInfo {
+	backups := []BackupInfo{}
+	for i := len(c.backups) - 1; i >= 0; i-- {
+		info := c.backups[i]
+		size := info.int64("size") + c.requiredWalSize(info)
+		walSize, _, _ := c.walsAfter(i)
+		entry := BackupInfo{
+			BackupID:        info["backup_id"],
+			RetentionStatus: "-",
+			Size:            formatSize(float64(size)),
+			SizeBytes:       size,
+			Status:          info["status"],
+			WalSize:         formatSize(float64(walSize)),
+			WalSizeBytes:    int(walSize),
+		}
+		if end, ok := info.time("end_time"); ok {
+			entry.EndTime, entry.EndTimeTimestamp = formatTimestamp(end)
+		}
+		backups = append(backups, entry)
+	}
+
+	return backups
+}
+
+func (d DiskClient) ShowBackup(_ context.Context, server, id string) (BarmanShowBackup, error) {
+	catalog, err := d.readCatalog(server)
+	if err != nil {
+		return nil, err
+	}
+
+	show, ok := catalog.showBackup(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown backup %s of %s", id, server)
+	}
+
+	return BarmanShowBackup{server: show}, nil
+}
+
+// showBackup builds the details of a backup like barman show-backup, false if it isn't in the catalog
+func (c *diskCatalog) showBackup(id string) (ShowBackupInfo, bool) {
+	index := c.find(id)
+	if index < 0 {
+		return ShowBackupInfo{}, false
+	}
+	info := c.backups[index]
+	stats := info.copyStats()
+	size := info.int64("size")
+	walSize, walFiles, lastWal := c.walsAfter(index)
+
+	show := ShowBackupInfo{
+		BackupID:          id,
+		PgdataDirectory:   info["pgdata"],
+		PostgresqlVersion: int(info.int64("version")),
+		Status:            info["status"],
+		XlogSegmentSize:   info.int64("xlog_segment_size"),
+		WalInformation: WalInformation{
+			DiskUsage:      formatSize(float64(walSize)),
+			DiskUsageBytes: int(walSize),
+			LastAvailable:  lastWal,
+			NoOfFiles:      walFiles,
+		},
+	}
+
+	base := &show.BaseBackupInformation
+	base.BeginLsn = info["begin_xlog"]
+	base.BeginOffset = int(info.int64("begin_offset"))
+	base.BeginWal = info["begin_wal"]
+	base.EndLsn = info["end_xlog"]
+	base.EndOffset = int(info.int64("end_offset"))
+	base.EndWal = info["end_wal"]
+	base.Timeline = int(info.int64("timeline"))
+	base.DiskUsage = formatSize(float64(size))
+	base.DiskUsageBytes = size
+	base.DiskUsageWithWalsBytes = size + c.requiredWalSize(info)
+	base.DiskUsageWithWals = formatSize(float64(base.DiskUsageWithWalsBytes))
+	base.IncrementalSizeBytes = info.int64("deduplicated_size")
+	base.IncrementalSize = formatSize(float64(base.IncrementalSizeBytes))
+	base.CopyTimeSeconds = stats["copy_time"]
+	base.AnalysisTimeSeconds = stats["analysis_time"]
+	base.NumberOfWorkers = int(stats["number_of_workers"])
+	if base.CopyTimeSeconds > 0 {
+		base.ThroughputBytes = float64(size) / base.CopyTimeSeconds
+	}
+
+	begin, hasBegin := info.time("begin_time")
+	if hasBegin {
+		base.BeginTime = info["begin_time"]
+		base.BeginTimeTimestamp = strconv.FormatInt(begin.Unix(), 10)
+	}
+	end, hasEnd := info.time("end_time")
+	if hasEnd {
+		base.EndTime = info["end_time"]
+		base.EndTimeTimestamp = strconv.FormatInt(end.Unix(), 10)
+	}
+
+	show.CatalogInformation.PreviousBackup = "- (this is the oldest base backup)"
+	for i := index - 1; i >= 0; i-- {
+		if c.backups[i]["status"] == "DONE" {
+			show.CatalogInformation.PreviousBackup = c.backups[i]["backup_id"]
+			break
+		}
+	}
+	show.CatalogInformation.NextBackup = "- (this is the latest base backup)"
+	if next := c.nextDone(index); next != nil {
+		show.CatalogInformation.NextBackup = next["backup_id"]
+	}
+
+	return show, true
+}
@@ -0,0 +1,119 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var testDiskClient = DiskClient{Home: "tests/barman_home"}
+
+func TestParseBackupInfo(t *testing.T) {
+	info, err := parseBackupInfo(strings.NewReader("status=DONE\nerror=None\nbackup_label='START WAL'\nsize=10\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "DONE", info["status"])
+	assert.Equal(t, "", info["error"])
+	assert.Equal(t, "START WAL", info["backup_label"])
+	assert.Equal(t, int64(10), info.int64("size"))
+}
+
+func TestDiskListServer(t *testing.T) {
+	servers, err := testDiskClient.ListServer(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, servers, 1)
+	assert.Contains(t, servers, "host1")
+}
+
+func TestDiskStatus(t *testing.T) {
+	status, err := testDiskClient.Status(context.Background(), "host1")
+	assert.NoError(t, err)
+	info := status["host1"]
+	assert.Equal(t, "3", info.BackupsNumber.Message)
+	assert.Equal(t, "20220225T070004", info.FirstBackup.Message)
+	assert.Equal(t, "20220227T070011", info.LastBackup.Message)
+	assert.Equal(t, "000000010000006B000000E0, at Mon Feb 28 21:56:57 2022", info.LastArchivedWal.Message)
+	assert.Equal(t, "2 (000000010000006A000000B8 at Mon Feb 28 02:26:30 2022)", info.FailedCount.Message)
+
+	_, err = testDiskClient.Check(context.Background(), "host1")
+	assert.True(t, errors.Is(err, errNotSupported))
+}
+
+func TestDiskListBackup(t *testing.T) {
+	list, err := testDiskClient.ListBackup(context.Background(), "host1")
+	assert.NoError(t, err)
+	backups := list["host1"]
+	if assert.Len(t, backups, 4) {
+		assert.Equal(t, "20220228T070002", backups[0].BackupID)
+		assert.Equal(t, "STARTED", backups[0].Status)
+		assert.Equal(t, 0, backups[0].WalSizeBytes)
+
+		assert.Equal(t, "20220227T070011", backups[1].BackupID)
+		assert.Equal(t, "1645947164", backups[1].EndTimeTimestamp)
+		// 4 WAL files are required by the backup, 430 were archived after it
+		assert.Equal(t, int64(36283357259+4*2097152), backups[1].SizeBytes)
+		assert.Equal(t, 430*2097152, backups[1].WalSizeBytes)
+	}
+}
+
+func TestDiskShowBackup(t *testing.T) {
+	show, err := testDiskClient.ShowBackup(context.Background(), "host1", "20220227T070011")
+	assert.NoError(t, err)
+	info := show["host1"]
+	assert.Equal(t, "DONE", info.Status)
+	assert.Equal(t, "000000010000006A0000002F", info.BaseBackupInformation.BeginWal)
+	assert.Equal(t, "1645945211", info.BaseBackupInformation.BeginTimeTimestamp)
+	assert.Equal(t, 1670.4918, info.BaseBackupInformation.CopyTimeSeconds)
+	assert.Equal(t, 2, info.BaseBackupInformation.NumberOfWorkers)
+	assert.Equal(t, "20220226T070004", info.CatalogInformation.PreviousBackup)
+	assert.Equal(t, "000000010000006B000000E0", info.WalInformation.LastAvailable)
+	assert.Equal(t, 430, info.WalInformation.NoOfFiles)
+	assert.Equal(t, int64(16777216), info.XlogSegmentSize)
+	backupInfo, err := testDiskClient.readBackupInfo("host1", "20220227T070011")
+	assert.NoError(t, err)
+	assert.Equal(t, "rsync-exclusive", backupInfo["mode"])
+	_, err = testDiskClient.readBackupInfo("host1", "20220101T000000")
+	assert.Error(t, err)
+
+	_, err = testDiskClient.ShowBackup(context.Background(), "host1", "20220101T000000")
+	assert.Error(t, err)
+}
+
+func TestDiskExporter(t *testing.T) {
+	exporter := NewExporter(testDiskClient, DefaultOptions())
+	exporter.clock = fakeClock{}
+	exporter.Refresh(context.Background())
+
+	r := prometheus.NewRegistry()
+	r.MustRegister(exporter)
+	value, ok := metricValue(t, r, "barman_up", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+	value, ok = metricValue(t, r, "barman_backups_count", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(3), value)
+	// the checks can't be read from disk
+	assert.Equal(t, 0, testutil.CollectAndCount(exporter, "barman_check_ok"))
+}
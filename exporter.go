@@ -0,0 +1,533 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Options configures what is collected by an Exporter
+type Options struct {
+	// CheckHints enables the barman_check_hint_info metric
+	CheckHints bool
+	// BackupMetrics enables the barman_backup_* metrics for every backup of the catalog
+	BackupMetrics bool
+	// MaxBackups limits the number of backups per server exported by BackupMetrics
+	MaxBackups int
+	// Concurrency limits the number of servers collected at the same time
+	Concurrency int
+	// ServerTimeout limits the time spent running the barman commands of a single server
+	ServerTimeout time.Duration
+	// ScrapeTimeout limits the collection triggered by a scrape, the servers not collected in
+	// time keep their previous results. 0 to disable.
+	ScrapeTimeout time.Duration
+	// OnScrape collects the servers when the metrics are scraped instead of on a timer
+	OnScrape bool
+	// MinInterval is the minimum time between two collections triggered by scrapes
+	MinInterval time.Duration
+	// BarmanConfig is the path of barman.conf, the configuration metrics are disabled if empty
+	BarmanConfig string
+	// ServerInclude limits the collection to the servers matching it, all servers if nil
+	ServerInclude *regexp.Regexp
+	// ServerExclude skips the servers matching it, it takes precedence over ServerInclude
+	ServerExclude *regexp.Regexp
+	// SkipInactive stops the collection of the disabled or inactive servers after barman status
+	SkipInactive bool
+	// WalGaps enables the scan of the WAL archives in BarmanHome for missing segments
+	WalGaps bool
+	// DiagnoseInterval is the minimum time between two runs of barman diagnose, 0 to disable
+	DiagnoseInterval time.Duration
+	// VerifyTimeout limits the time barman check-backup and verify-backup can run, 0 to disable
+	VerifyTimeout time.Duration
+	// VerifyStateFile keeps the results of the backup verifications across restarts, in memory
+	// only if empty
+	VerifyStateFile string
+	// VerifyExisting verifies the backups already DONE when a server is first seen, otherwise
+	// they are recorded as the baseline and only the new backups are verified
+	VerifyExisting bool
+	// Replication enables the barman_replication_* metrics read from barman replication-status
+	Replication bool
+	// BarmanHome is the barman_home directory of the local barman, read for the WAL segment size
+	// of the backups and by WalGaps. Empty if barman doesn't run on this host.
+	BarmanHome string
+	// Servers overrides the options of single servers
+	Servers map[string]ServerConfig
+}
+
+// forServer returns the options with the overrides of the server applied
+func (o Options) forServer(server string) Options {
+	override, ok := o.Servers[server]
+	if !ok {
+		return o
+	}
+	if override.CheckHints != nil {
+		o.CheckHints = *override.CheckHints
+	}
+	if override.BackupMetrics != nil {
+		o.BackupMetrics = *override.BackupMetrics
+	}
+	if override.MaxBackups != nil {
+		o.MaxBackups = *override.MaxBackups
+	}
+
+	return o
+}
+
+// included returns true if the server passes the include and exclude filters
+func (o Options) included(server string) bool {
+	if o.ServerInclude != nil && !o.ServerInclude.MatchString(server) {
+		return false
+	}
+
+	return o.ServerExclude == nil || !o.ServerExclude.MatchString(server)
+}
+
+// remote returns the options of the exporters of the servers not managed by the local barman, the
+// local barman.conf and barman_home don't describe them
+func (o Options) remote() Options {
+	o.BarmanConfig = ""
+	o.BarmanHome = ""
+	o.WalGaps = false
+
+	return o
+}
+
+// DefaultOptions returns the options used when no flag is given
+func DefaultOptions() Options {
+	return Options{
+		MaxBackups:       10,
+		Concurrency:      4,
+		ServerTimeout:    2 * time.Minute,
+		ScrapeTimeout:    10 * time.Minute,
+		MinInterval:      time.Minute,
+		DiagnoseInterval: time.Hour,
+		VerifyTimeout:    time.Hour,
+	}
+}
+
+// errUnknownServer is returned by Probe for the servers it doesn't collect
+var errUnknownServer = errors.New("unknown server")
+
+// Exporter collects the barman metrics of every server. The result of the last collection is
+// cached and swapped atomically so a scrape never sees a half-updated cycle.
+type Exporter struct {
+	options Options
+	clock   Clock
+	client  BarmanClient
+
+	// refreshMu serializes the collection cycles
+	refreshMu sync.Mutex
+
+	// mu guards the result of the last collection
+	mu                 sync.RWMutex
+	results            []*serverData
+	servers            map[string]bool
+	lastCollection     time.Time
+	collectionDuration time.Duration
+	// listError is the failure of list-server in the last collection
+	listError error
+	// versions are read from barman diagnose, nil until it succeeds
+	versions *barmanVersions
+	// diagnosedAt is the time of the last barman diagnose, guarded by refreshMu
+	diagnosedAt time.Time
+
+	// verifyMu guards the results of the backup verifications per server and backup
+	verifyMu sync.Mutex
+	verified map[string]map[string]backupVerification
+	// verifyLoaded is set once the results were read from VerifyStateFile or the exporter
+	// replaced by a reload
+	verifyLoaded bool
+
+	// cacheMu guards the details of the DONE backups kept between collections
+	cacheMu   sync.Mutex
+	showCache map[string]map[string]ShowBackupInfo
+
+	checkUnrecognized *prometheus.CounterVec
+	commandTimeouts   *prometheus.CounterVec
+	commandDuration   *prometheus.HistogramVec
+	commandErrors     *prometheus.CounterVec
+}
+
+// NewExporter creates an exporter reading the data from the client, the collection runs on
+// Refresh or on scrape if OnScrape is set
+func NewExporter(client BarmanClient, options Options) *Exporter {
+	e := &Exporter{
+		options:   options,
+		clock:     realClock{},
+		servers:   map[string]bool{},
+		showCache: map[string]map[string]ShowBackupInfo{},
+		verified:  map[string]map[string]backupVerification{},
+		checkUnrecognized: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "barman_check_unrecognized_total",
+			Help: "Number of times barman check reported a check unknown to the exporter",
+		}, []string{"server", "check"}),
+		commandTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "barman_exporter_command_timeouts_total",
+			Help: "Number of barman commands killed after reaching the timeout",
+		}, []string{"command"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "barman_exporter_command_duration_seconds",
+			Help:    "Duration of the barman command invocations",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 1800},
+		}, []string{"command", "server"}),
+		commandErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "barman_exporter_command_errors_total",
+			Help: "Number of failed barman command invocations",
+		}, []string{"command", "server", "reason"}),
+	}
+	e.client = observedClient{
+		client:   client,
+		duration: e.commandDuration,
+		errors:   e.commandErrors,
+		timeouts: e.commandTimeouts,
+	}
+
+	return e
+}
+
+// Describe implements prometheus.Collector
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range descriptors {
+		ch <- desc
+	}
+	e.checkUnrecognized.Describe(ch)
+	e.commandTimeouts.Describe(ch)
+	e.commandDuration.Describe(ch)
+	e.commandErrors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	if e.options.OnScrape {
+		// a hung barman would otherwise hold refreshMu and block every later scrape
+		ctx := context.Background()
+		if e.options.ScrapeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, e.options.ScrapeTimeout)
+			defer cancel()
+		}
+		e.refreshIfStale(ctx)
+	}
+
+	e.mu.RLock()
+	results := e.results
+	last := e.lastCollection
+	duration := e.collectionDuration
+	versions := e.versions
+	e.mu.RUnlock()
+
+	now := e.clock.Now()
+	for _, data := range results {
+		data.collect(ch, now, e.options.forServer(data.server))
+	}
+	if !last.IsZero() {
+		gauge(ch, lastCollection, float64(last.Unix()))
+		gauge(ch, collectionDuration, duration.Seconds())
+	}
+	e.collectVerified(ch, now)
+	if versions != nil {
+		gauge(ch, versionInfo, 1, versions.barman, versions.python, versions.rsync, versions.ssh, versions.kernel)
+	}
+
+	e.checkUnrecognized.Collect(ch)
+	e.commandTimeouts.Collect(ch)
+	e.commandDuration.Collect(ch)
+	e.commandErrors.Collect(ch)
+}
+
+// refreshIfStale runs a collection unless the last one is newer than MinInterval
+func (e *Exporter) refreshIfStale(ctx context.Context) {
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+
+	e.mu.RLock()
+	last := e.lastCollection
+	e.mu.RUnlock()
+	if !last.IsZero() && e.clock.Now().Sub(last) < e.options.MinInterval {
+		return
+	}
+
+	e.refresh(ctx)
+}
+
+// Refresh runs a collection cycle and replaces the exported results
+func (e *Exporter) Refresh(ctx context.Context) {
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+
+	e.refresh(ctx)
+}
+
+// refresh lists the servers and collects them, the returned error is the failure of list-server
+func (e *Exporter) refresh(ctx context.Context) error {
+	start := time.Now()
+
+	serverList, err := e.client.ListServer(ctx)
+
+	e.mu.RLock()
+	previous := e.servers
+	e.mu.RUnlock()
+
+	servers := map[string]bool{}
+	if err == nil {
+		for server := range serverList {
+			if e.options.included(server) {
+				servers[server] = true
+			}
+		}
+	} else {
+		// keep collecting the last known servers, the current set is only known when list-server succeeds
+		log.Printf("failed to run barman list-server: %v", err)
+		servers = previous
+	}
+
+	e.refreshDiagnose(ctx)
+	e.update(ctx, servers, start)
+	if ctx.Err() == nil {
+		e.mu.Lock()
+		e.listError = err
+		e.mu.Unlock()
+	}
+
+	return err
+}
+
+// update collects the servers and replaces the exported results
+func (e *Exporter) update(ctx context.Context, servers map[string]bool, start time.Time) {
+	e.mu.RLock()
+	previous := e.servers
+	e.mu.RUnlock()
+
+	names := make([]string, 0, len(servers))
+	for server := range servers {
+		names = append(names, server)
+	}
+	sort.Strings(names)
+
+	results := e.fetchServers(ctx, names)
+	e.applyConfig(results)
+	if ctx.Err() != nil {
+		// the collection was canceled (shutdown or scrape timeout), the servers collected are
+		// published and the others keep their previous results
+		results = e.keepPrevious(results)
+	}
+
+	for server := range previous {
+		if !servers[server] {
+			log.Printf("Removing metrics of server %s", server)
+			labels := prometheus.Labels{"server": server}
+			e.checkUnrecognized.DeletePartialMatch(labels)
+			e.commandDuration.DeletePartialMatch(labels)
+			e.commandErrors.DeletePartialMatch(labels)
+			e.cacheMu.Lock()
+			delete(e.showCache, server)
+			e.cacheMu.Unlock()
+		}
+	}
+
+	e.mu.Lock()
+	e.results = results
+	e.servers = servers
+	e.lastCollection = e.clock.Now()
+	e.collectionDuration = time.Since(start)
+	e.mu.Unlock()
+}
+
+// keepPrevious replaces the servers whose collection was canceled by their previous results, the
+// ones never collected are left out until the next collection
+func (e *Exporter) keepPrevious(results []*serverData) []*serverData {
+	e.mu.RLock()
+	previous := make(map[string]*serverData, len(e.results))
+	for _, data := range e.results {
+		previous[data.server] = data
+	}
+	e.mu.RUnlock()
+
+	kept := make([]*serverData, 0, len(results))
+	for _, data := range results {
+		if !data.canceled {
+			kept = append(kept, data)
+		} else if last, ok := previous[data.server]; ok {
+			kept = append(kept, last)
+		}
+	}
+
+	return kept
+}
+
+// applyConfig attaches the server sections of barman.conf and the overridden settings to the
+// collected servers, the file is read on every cycle so the changes are picked without restarting
+// the exporter
+func (e *Exporter) applyConfig(results []*serverData) {
+	config := e.readBarmanConfig()
+	for _, data := range results {
+		data.config = e.serverConfig(config, data.server)
+	}
+}
+
+// readBarmanConfig reads barman.conf, the configuration is empty if it isn't set or can't be read
+func (e *Exporter) readBarmanConfig() *barmanConfig {
+	if e.options.BarmanConfig != "" {
+		loaded, err := loadBarmanConfig(e.options.BarmanConfig)
+		if err == nil {
+			return loaded
+		}
+		log.Printf("failed to read the barman configuration: %v", err)
+	}
+
+	return &barmanConfig{servers: map[string]serverConfig{}}
+}
+
+// serverConfig returns the section of the server in barman.conf with the overridden settings
+func (e *Exporter) serverConfig(config *barmanConfig, server string) serverConfig {
+	section := config.servers[server]
+	settings := e.options.Servers[server].Settings
+	if len(settings) == 0 {
+		return section
+	}
+
+	merged := serverConfig{}
+	for key, value := range section {
+		merged[key] = value
+	}
+	for key, value := range settings {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// Probe collects a single server, or every server listed by barman if server is empty, and
+// returns true if all the barman commands succeeded. A server excluded by the filters or not
+// listed by barman is rejected with errUnknownServer.
+func (e *Exporter) Probe(ctx context.Context, server string) (bool, error) {
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+
+	if server == "" {
+		if err := e.refresh(ctx); err != nil {
+			return false, nil
+		}
+	} else {
+		if !e.options.included(server) {
+			return false, fmt.Errorf("%w: %s", errUnknownServer, server)
+		}
+		servers, err := e.client.ListServer(ctx)
+		if err != nil {
+			log.Printf("failed to run barman list-server: %v", err)
+			return false, nil
+		}
+		if _, ok := servers[server]; !ok {
+			return false, fmt.Errorf("%w: %s", errUnknownServer, server)
+		}
+		e.update(ctx, map[string]bool{server: true}, time.Now())
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if ctx.Err() != nil {
+		return false, nil
+	}
+	for _, data := range e.results {
+		if data.failed {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// ServerStatus is the state of a server in the last collection
+type ServerStatus struct {
+	Name     string
+	Up       bool
+	Skipped  string
+	Failures []string
+}
+
+// CollectionStatus describes the last collection, shown on the landing page
+type CollectionStatus struct {
+	LastCollection time.Time
+	Duration       time.Duration
+	ListError      error
+	Servers        []ServerStatus
+}
+
+// Status returns the state of the last collection
+func (e *Exporter) Status() CollectionStatus {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	status := CollectionStatus{
+		LastCollection: e.lastCollection,
+		Duration:       e.collectionDuration,
+		ListError:      e.listError,
+	}
+	for _, data := range e.results {
+		status.Servers = append(status.Servers, ServerStatus{
+			Name:     data.server,
+			Up:       !data.failed,
+			Skipped:  data.skipped,
+			Failures: data.failures,
+		})
+	}
+
+	return status
+}
+
+// Ready returns true when a collection completed and barman could list the servers. In on-scrape
+// mode the exporter is ready before the first scrape as nothing is collected until then.
+func (e *Exporter) Ready() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.lastCollection.IsZero() {
+		return e.options.OnScrape
+	}
+
+	return e.listError == nil
+}
+
+// Run refreshes the metrics every interval or when signal is received until ctx is done
+func (e *Exporter) Run(ctx context.Context, signal chan os.Signal, interval time.Duration) {
+	e.Refresh(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Exiting metrics loop")
+			return // avoid leaking of this goroutine when ctx is done.
+		case <-signal:
+			log.Printf("Running metrics (SIGUSR1)")
+			e.Refresh(ctx)
+		case <-e.clock.After(interval):
+			log.Printf("Running metrics")
+			e.Refresh(ctx)
+		}
+	}
+}
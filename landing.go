@@ -0,0 +1,129 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+var landingTemplate = template.Must(template.New("landing").Funcs(template.FuncMap{
+	"timestamp": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Barman Exporter</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.down { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Barman Exporter</h1>
+<p>Version {{.Version}}, commit {{.Commit}}</p>
+<p><a href="{{.MetricsPath}}">Metrics</a> | <a href="/-/healthy">Health</a> | <a href="/-/ready">Readiness</a></p>
+{{range .Hosts}}
+<h2>{{if .Host}}{{.Host}}{{else}}Local barman{{end}}</h2>
+<p>Last collection: {{timestamp .Status.LastCollection}}{{if not .Status.LastCollection.IsZero}} (took {{.Status.Duration}}){{end}}</p>
+{{if .Status.ListError}}<p class="down">barman list-server failed: {{.Status.ListError}}</p>{{end}}
+<table>
+<tr><th>Server</th><th>State</th><th>Errors</th></tr>
+{{range .Status.Servers}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{if .Skipped}}skipped ({{.Skipped}}){{else if .Up}}up{{else}}<span class="down">down</span>{{end}}</td>
+<td>{{range .Failures}}{{.}}<br>{{end}}</td>
+</tr>
+{{else}}
+<tr><td colspan="3">No servers collected</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+type landingHost struct {
+	Host   string
+	Status CollectionStatus
+}
+
+type landingPage struct {
+	Version     string
+	Commit      string
+	MetricsPath string
+	Hosts       []landingHost
+}
+
+// healthyHandler reports that the process is alive
+func healthyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Healthy.\n"))
+	})
+}
+
+// ReadyHandler reports if every exporter completed a collection and reached barman
+func (s *service) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		exporters := s.state.exporters
+		s.mu.RUnlock()
+
+		for _, exporter := range exporters {
+			if !exporter.Ready() {
+				http.Error(w, "Not ready.", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		_, _ = w.Write([]byte("Ready.\n"))
+	})
+}
+
+// LandingHandler shows the servers of the last collections
+func (s *service) LandingHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		s.mu.RLock()
+		state := s.state
+		s.mu.RUnlock()
+
+		page := landingPage{Version: Version, Commit: Commit, MetricsPath: state.config.MetricsPath}
+		for i, exporter := range state.exporters {
+			page.Hosts = append(page.Hosts, landingHost{Host: state.hosts[i], Status: exporter.Status()})
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := landingTemplate.Execute(w, page); err != nil {
+			log.Printf("Failed to render the landing page: %v", err)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func get(handler http.Handler, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	config := testConfig()
+	config.Backend = "fixtures"
+	config.FixturesDir = "tests/fixtures"
+	svc := newService(func() (Config, error) { return config, nil })
+	assert.NoError(t, svc.Reload())
+	defer svc.Stop()
+
+	assert.Equal(t, http.StatusOK, get(healthyHandler(), "/-/healthy").Code)
+	assert.Eventually(t, func() bool {
+		return get(svc.ReadyHandler(), "/-/ready").Code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// barman can't list the servers
+	config.FixturesDir = t.TempDir()
+	assert.NoError(t, svc.Reload())
+	assert.Equal(t, http.StatusServiceUnavailable, get(svc.ReadyHandler(), "/-/ready").Code)
+	assert.Eventually(t, func() bool {
+		return svc.state.exporters[0].Status().ListError != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, get(svc.ReadyHandler(), "/-/ready").Code)
+}
+
+func TestLandingPage(t *testing.T) {
+	config := testConfig()
+	config.Backend = "fixtures"
+	config.FixturesDir = "tests/fixtures"
+	config.CollectOnScrape = true
+	svc := newService(func() (Config, error) { return config, nil })
+	assert.NoError(t, svc.Reload())
+	defer svc.Stop()
+
+	recorder := get(svc.LandingHandler(), "/")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "Last collection: never")
+	assert.Equal(t, http.StatusOK, get(svc.ReadyHandler(), "/-/ready").Code)
+
+	get(svc.MetricsHandler(), "/metrics")
+	body := get(svc.LandingHandler(), "/").Body.String()
+	assert.Contains(t, body, `<a href="/metrics">`)
+	assert.Contains(t, body, "<td>host1</td>")
+	assert.NotContains(t, body, "Last collection: never")
+
+	assert.Equal(t, http.StatusNotFound, get(svc.LandingHandler(), "/missing").Code)
+}
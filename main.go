@@ -22,49 +22,20 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
+	"path/filepath"
+	"regexp"
 	"syscall"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli/v2"
 )
 
 const versionFormatter = `barman-exporter version: %s, commit: %s, built at: %s`
 
-var (
-	status = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "barman_status",
-		Help: "1 if server passes all diagnostics",
-	}, []string{"server"})
-	lastWalAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "barman_last_wal_age_seconds",
-		Help: "Time since last received wal",
-	}, []string{"server"})
-	lastBackupAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "barman_last_backup_age_seconds",
-		Help: "Time since last full backup",
-	}, []string{"server"})
-	lastBackupSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "barman_last_backup_size_bytes",
-		Help: "Size of last backup",
-	}, []string{"server"})
-	backupDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "barman_backup_duration_seconds",
-		Help: "Duration of last backup",
-	}, []string{"server"})
-	backupWindow = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "barman_backup_window_seconds",
-		Help: "Time range for PITR",
-	}, []string{"server"})
-)
-
 type Clock interface {
 	Now() time.Time
 	After(d time.Duration) <-chan time.Time
@@ -75,14 +46,22 @@ type realClock struct{}
 func (realClock) Now() time.Time                         { return time.Now() }
 func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
 
-var clock Clock = realClock{}
+// compileServerFilter compiles a filter matching the whole server name
+func compileServerFilter(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
 
-func printVersion(c *cli.Context) {
-	_, _ = fmt.Fprintf(c.App.Writer, versionFormatter, Version, Commit, BuildTime)
+func homeDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return home
 }
 
-func addGaugeServer(gauge *prometheus.GaugeVec, server string) prometheus.Gauge {
-	return gauge.With(prometheus.Labels{"server": server})
+func printVersion(c *cli.Context) {
+	_, _ = fmt.Fprintf(c.App.Writer, versionFormatter, Version, Commit, BuildTime)
 }
 
 func convertDateToTimestamp(date string) int64 {
@@ -95,160 +74,123 @@ func convertDateToTimestamp(date string) int64 {
 	}
 }
 
-func collectMetrics() error {
-	servers, err := barmanListServer()
-	if err != nil {
-		log.Printf("failed to run barman list-server: %v", err)
-	}
-
-	for server := range servers {
-		serverCheck, err := barmanCheck(server)
-		if err == nil {
-			check := serverCheck[server]
-			if check.AllOk() {
-				addGaugeServer(status, server).Set(1)
-			} else {
-				addGaugeServer(status, server).Set(0)
-			}
-		} else {
-			log.Printf("Failed to run barman check %s: %v", server, err)
-		}
-
-		now := clock.Now()
-		var lastWalTimestamp int64
-
-		infoList, err := barmanStatus(server)
-		if err == nil {
-			info := infoList[server]
-			dateParts := strings.Split(info.LastArchivedWal.Message, ", at ")
-			if len(dateParts) == 2 {
-				lastWalTimestamp = convertDateToTimestamp(dateParts[1])
-				addGaugeServer(lastWalAge, server).Set(float64(now.Unix() - lastWalTimestamp))
-			}
-
-		} else {
-			log.Printf("Failed to run barman status %s: %v", server, err)
-		}
-
-		backups, err := barmanListBackup(server)
-		if err != nil {
-			log.Printf("Failed to run barman list-backup %s: %v", server, err)
-		} else {
-			backupList := backups[server]
-			var backupEntries []BackupInfo
-			for _, entry := range backupList {
-				if entry.Status == "DONE" {
-					backupEntries = append(backupEntries, entry)
-				}
-			}
-
-			if len(backupEntries) > 0 {
-				first := backupEntries[len(backupEntries)-1]
-				last := backupEntries[0]
-				addGaugeServer(lastBackupSize, server).Set(float64(last.SizeBytes))
-				showList, err := barmanShowBackup(server, last.BackupID)
-				if err != nil {
-					log.Printf("Failed to run barman show-backup %s %s: %v", server, last.BackupID, err)
-				}
-
-				showLast := showList[server]
-				backupStart, err := strconv.ParseInt(showLast.BeginTimeTimestamp, 10, 64)
-				if err == nil {
-					addGaugeServer(lastBackupAge, server).Set(float64(now.Unix() - backupStart))
-				} else {
-					log.Printf("failed to convert BeginTime timestamp: %v", err)
-				}
-
-				showList, err = barmanShowBackup(server, first.BackupID)
-				if err != nil {
-					log.Printf("Failed to run barman show-backup %s %s: %v", server, last.BackupID, err)
-				}
-
-				showFirst := showList[server]
-				backupEnd, err := strconv.ParseInt(showLast.EndTimeTimestamp, 10, 64)
-				if err == nil {
-					addGaugeServer(backupDuration, server).Set(float64(backupEnd - backupStart))
-				} else {
-					log.Printf("failed to convert EndTime timestamp: %v", err)
-				}
-
-				firstFull, err := strconv.ParseInt(showFirst.BeginTimeTimestamp, 10, 64)
-				if err == nil {
-					addGaugeServer(backupWindow, server).Set(float64(lastWalTimestamp - firstFull))
-				}
-			}
-		}
-	}
-
-	return nil
-}
-
-func collectMetricsLoop(ctx context.Context, signal chan os.Signal, interval time.Duration) error {
-	if err := collectMetrics(); err != nil {
-		return err
-	}
-	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("Exiting metrics loop")
-			return nil // avoid leaking of this goroutine when ctx is done.
-		case <-signal:
-			log.Printf("Running metrics (SIGUSR1)")
-			if err := collectMetrics(); err != nil {
-				return err
-			}
-		case <-time.After(interval):
-			log.Printf("Running metrics")
-			if err := collectMetrics(); err != nil {
-				return err
-			}
-		}
+// configFromFlags returns the configuration given on the command line
+func configFromFlags(c *cli.Context) Config {
+	return Config{
+		Listen:             c.String("listen"),
+		WebConfigFile:      c.String("web.config.file"),
+		MetricsPath:        c.String("metrics-path"),
+		Interval:           c.Duration("interval"),
+		CollectOnScrape:    c.Bool("collect-on-scrape"),
+		MinRefreshInterval: c.Duration("min-refresh-interval"),
+		Concurrency:        c.Int("concurrency"),
+		ServerTimeout:      c.Duration("server-timeout"),
+		ScrapeTimeout:      c.Duration("scrape-timeout"),
+		CommandTimeout:     c.Duration("command-timeout"),
+		DiagnoseInterval:   c.Duration("diagnose-interval"),
+		VerifyInterval:     c.Duration("verify-interval"),
+		VerifyTimeout:      c.Duration("verify-timeout"),
+		VerifyStateFile:    c.String("verify-state-file"),
+		VerifyExisting:     c.Bool("verify-existing"),
+		Backend:            c.String("backend"),
+		BarmanPath:         c.String("barman-path"),
+		BarmanHome:         c.String("barman-home"),
+		BarmanConfig:       c.String("barman-config"),
+		FixturesDir:        c.String("fixtures-dir"),
+		RecordDir:          c.String("record-dir"),
+		SSH: SSHConfig{
+			Hosts:          c.StringSlice("ssh-host"),
+			User:           c.String("ssh-user"),
+			Keys:           c.StringSlice("ssh-key"),
+			KnownHosts:     c.String("ssh-known-hosts"),
+			ConnectTimeout: c.Duration("ssh-connect-timeout"),
+			ProbeAnyHost:   c.Bool("ssh-probe-any-host"),
+		},
+		Cloud: CloudConfig{
+			URL:      c.String("cloud-url"),
+			Endpoint: c.String("cloud-endpoint"),
+			Region:   c.String("cloud-region"),
+		},
+		ServerInclude: c.String("server-include"),
+		ServerExclude: c.String("server-exclude"),
+		SkipInactive:  c.Bool("skip-inactive"),
+		Metrics: MetricsConfig{
+			CheckHints:    c.Bool("check-hints"),
+			BackupMetrics: c.Bool("backup-metrics"),
+			MaxBackups:    c.Int("max-backups"),
+			WalGaps:       c.Bool("wal-gaps"),
+			Replication:   c.Bool("replication-metrics"),
+		},
 	}
 }
 
 func run(c *cli.Context) error {
-	if c.IsSet("barman-path") {
-		barmanPath = c.String("barman-path")
+	svc := newService(func() (Config, error) {
+		config := configFromFlags(c)
+		if path := c.String("config.file"); path != "" {
+			return loadConfigFile(path, config)
+		}
+		return config, config.Validate()
+	})
+	if err := svc.Reload(); err != nil {
+		return err
 	}
 
-	c1, cancel := context.WithCancel(context.Background())
-	s := http.Server{Addr: c.String("listen")}
+	config := svc.Config()
+	s := http.Server{Addr: config.Listen}
 
 	signalUsr := make(chan os.Signal, 1)
 	signal.Notify(signalUsr, syscall.SIGUSR1)
+	signalHup := make(chan os.Signal, 1)
+	signal.Notify(signalHup, syscall.SIGHUP)
 	exitCh := make(chan os.Signal, 1)
 	signal.Notify(exitCh, os.Interrupt, syscall.SIGTERM)
 
-	go func(signal chan os.Signal) {
-		if err := collectMetricsLoop(c1, signal, c.Duration("interval")); err != nil {
-			log.Printf("failed to collect metrics: %v", err)
-		}
-		exitCh <- os.Interrupt
-	}(signalUsr)
-
-	r := prometheus.NewRegistry()
-	r.MustRegister(status, lastWalAge, lastBackupAge, lastBackupSize, backupDuration, backupWindow)
-	handler := promhttp.HandlerFor(r, promhttp.HandlerOpts{})
-
-	http.Handle(c.String("metrics-path"), handler)
+	http.Handle(config.MetricsPath, svc.MetricsHandler())
+	http.Handle("/probe", svc.ProbeHandler())
+	http.Handle("/-/reload", svc.ReloadHandler())
+	http.Handle("/-/healthy", healthyHandler())
+	http.Handle("/-/ready", svc.ReadyHandler())
+	http.Handle("/", svc.LandingHandler())
 	log.Printf("Starting web server")
 
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
 	go func() {
-		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := serveWeb(listener, &s, config.WebConfigFile); err != nil && err != http.ErrServerClosed {
 			log.Print(err)
 		}
 	}()
 
-	log.Printf("Waiting for metrics loop to finish")
-	<-exitCh
+	log.Printf("Waiting for exit signal")
+	for running := true; running; {
+		select {
+		case <-signalUsr:
+			log.Printf("Running metrics (SIGUSR1)")
+			svc.Refresh()
+		case <-signalHup:
+			if err := svc.Reload(); err != nil {
+				log.Printf("Failed to reload the configuration: %v", err)
+			} else {
+				log.Printf("Configuration reloaded (SIGHUP)")
+			}
+		case <-exitCh:
+			running = false
+		}
+	}
+
+	// cancel the running barman commands before waiting for the web server
+	svc.Stop()
 
 	log.Printf("Stopping web server")
-	if err := s.Shutdown(c1); err != nil {
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
 		log.Print(err)
 	}
 
-	cancel()
-
 	return nil
 }
 
@@ -259,12 +201,22 @@ func main() {
 	cli.VersionPrinter = printVersion
 
 	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config.file",
+			Usage:   "YAML configuration file, its settings take precedence over the flags (reloaded on SIGHUP or POST /-/reload)",
+			EnvVars: []string{"CONFIG_FILE"},
+		},
 		&cli.StringFlag{
 			Name:    "listen, l",
 			Usage:   "listen address",
 			Value:   ":8000",
 			EnvVars: []string{"LISTEN"},
 		},
+		&cli.StringFlag{
+			Name:    "web.config.file",
+			Usage:   "exporter toolkit web configuration file enabling TLS or basic authentication",
+			EnvVars: []string{"WEB_CONFIG_FILE"},
+		},
 		&cli.DurationFlag{
 			Name:    "interval, i",
 			Usage:   "interval",
@@ -283,6 +235,186 @@ func main() {
 			Value:   "barman",
 			EnvVars: []string{"BARMAN_PATH"},
 		},
+		&cli.StringFlag{
+			Name:    "backend",
+			Usage:   "source of the barman data: exec (run the barman commands), disk (read barman-home) or fixtures (replay fixtures-dir)",
+			Value:   "exec",
+			EnvVars: []string{"BACKEND"},
+		},
+		&cli.StringFlag{
+			Name:    "barman-home",
+			Usage:   "barman home directory read by the disk backend and by --wal-gaps",
+			Value:   "/var/lib/barman",
+			EnvVars: []string{"BARMAN_HOME"},
+		},
+		&cli.StringFlag{
+			Name:    "fixtures-dir",
+			Usage:   "directory with the command outputs replayed by the fixtures backend",
+			EnvVars: []string{"FIXTURES_DIR"},
+		},
+		&cli.StringFlag{
+			Name:    "record-dir",
+			Usage:   "save the output of every successful command in this directory",
+			EnvVars: []string{"RECORD_DIR"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "ssh-host",
+			Usage:   "run barman on this [user@]host[:port] over SSH, can be repeated",
+			EnvVars: []string{"SSH_HOSTS"},
+		},
+		&cli.StringFlag{
+			Name:    "ssh-user",
+			Usage:   "user of the SSH hosts without one",
+			Value:   "barman",
+			EnvVars: []string{"SSH_USER"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "ssh-key",
+			Usage:   "private key used to authenticate on the SSH hosts, can be repeated",
+			Value:   cli.NewStringSlice(filepath.Join(homeDir(), ".ssh", "id_rsa")),
+			EnvVars: []string{"SSH_KEYS"},
+		},
+		&cli.StringFlag{
+			Name:    "ssh-known-hosts",
+			Usage:   "known_hosts file verifying the keys of the SSH hosts",
+			Value:   filepath.Join(homeDir(), ".ssh", "known_hosts"),
+			EnvVars: []string{"SSH_KNOWN_HOSTS"},
+		},
+		&cli.DurationFlag{
+			Name:    "ssh-connect-timeout",
+			Usage:   "maximum time spent connecting to a SSH host",
+			Value:   10 * time.Second,
+			EnvVars: []string{"SSH_CONNECT_TIMEOUT"},
+		},
+		&cli.BoolFlag{
+			Name:    "ssh-probe-any-host",
+			Usage:   "allow /probe to connect to SSH hosts not given with --ssh-host",
+			EnvVars: []string{"SSH_PROBE_ANY_HOST"},
+		},
+		&cli.StringFlag{
+			Name:    "cloud-url",
+			Usage:   "barman-cloud destination of the catalogs to export, e.g. s3://bucket/prefix",
+			EnvVars: []string{"CLOUD_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "cloud-endpoint",
+			Usage:   "endpoint of the S3 compatible storage, defaults to AWS",
+			EnvVars: []string{"CLOUD_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:    "cloud-region",
+			Usage:   "region of the S3 bucket",
+			EnvVars: []string{"CLOUD_REGION"},
+		},
+		&cli.StringFlag{
+			Name:    "barman-config",
+			Usage:   "barman configuration file used to export the settings of every server, empty to disable (ignored with ssh-host)",
+			Value:   "/etc/barman.conf",
+			EnvVars: []string{"BARMAN_CONFIG"},
+		},
+		&cli.StringFlag{
+			Name:    "server-include",
+			Usage:   "only collect the servers fully matching this regular expression",
+			EnvVars: []string{"SERVER_INCLUDE"},
+		},
+		&cli.StringFlag{
+			Name:    "server-exclude",
+			Usage:   "skip the servers fully matching this regular expression",
+			EnvVars: []string{"SERVER_EXCLUDE"},
+		},
+		&cli.BoolFlag{
+			Name:    "skip-inactive",
+			Usage:   "stop collecting the disabled or inactive servers after barman status",
+			EnvVars: []string{"SKIP_INACTIVE"},
+		},
+		&cli.BoolFlag{
+			Name:    "check-hints",
+			Usage:   "export the hint of every barman check as a label",
+			EnvVars: []string{"CHECK_HINTS"},
+		},
+		&cli.BoolFlag{
+			Name:    "backup-metrics",
+			Usage:   "export metrics for every backup of the catalog",
+			EnvVars: []string{"BACKUP_METRICS"},
+		},
+		&cli.IntFlag{
+			Name:    "max-backups",
+			Usage:   "maximum number of backups per server exported by --backup-metrics",
+			Value:   10,
+			EnvVars: []string{"MAX_BACKUPS"},
+		},
+		&cli.BoolFlag{
+			Name:    "wal-gaps",
+			Usage:   "scan the WAL archive of the servers in barman-home for missing segments",
+			EnvVars: []string{"WAL_GAPS"},
+		},
+		&cli.BoolFlag{
+			Name:    "replication-metrics",
+			Usage:   "run barman replication-status to export the lag of the standbys and WAL streamers",
+			EnvVars: []string{"REPLICATION_METRICS"},
+		},
+		&cli.IntFlag{
+			Name:    "concurrency",
+			Usage:   "number of servers collected at the same time",
+			Value:   4,
+			EnvVars: []string{"CONCURRENCY"},
+		},
+		&cli.DurationFlag{
+			Name:    "server-timeout",
+			Usage:   "maximum time spent collecting a single server, 0 to disable",
+			Value:   time.Minute * 2,
+			EnvVars: []string{"SERVER_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "scrape-timeout",
+			Usage:   "maximum time spent in a collection triggered by a scrape, 0 to disable",
+			Value:   time.Minute * 10,
+			EnvVars: []string{"SCRAPE_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "command-timeout",
+			Usage:   "maximum time a single barman command can run, 0 to disable",
+			Value:   time.Minute,
+			EnvVars: []string{"COMMAND_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "diagnose-interval",
+			Usage:   "minimum time between two runs of barman diagnose to read the barman version, 0 to disable",
+			Value:   time.Hour,
+			EnvVars: []string{"DIAGNOSE_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:    "verify-interval",
+			Usage:   "verify the new DONE backups with barman check-backup and verify-backup every interval, 0 to disable",
+			EnvVars: []string{"VERIFY_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:    "verify-timeout",
+			Usage:   "maximum time barman check-backup or verify-backup can run, 0 to disable",
+			Value:   time.Hour,
+			EnvVars: []string{"VERIFY_TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:    "verify-state-file",
+			Usage:   "file keeping the results of the backup verifications across restarts",
+			EnvVars: []string{"VERIFY_STATE_FILE"},
+		},
+		&cli.BoolFlag{
+			Name:    "verify-existing",
+			Usage:   "also verify the backups already taken when a server is first seen",
+			EnvVars: []string{"VERIFY_EXISTING"},
+		},
+		&cli.BoolFlag{
+			Name:    "collect-on-scrape",
+			Usage:   "collect the metrics when scraped instead of every interval",
+			EnvVars: []string{"COLLECT_ON_SCRAPE"},
+		},
+		&cli.DurationFlag{
+			Name:    "min-refresh-interval",
+			Usage:   "minimum time between two collections triggered by scrapes",
+			Value:   time.Minute,
+			EnvVars: []string{"MIN_REFRESH_INTERVAL"},
+		},
 	}
 
 	app.Action = run
@@ -19,11 +19,16 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"regexp"
+	"runtime"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,84 +37,532 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-var fakeExitCode = 0
-
 type fakeClock struct{}
 
 func (fakeClock) Now() time.Time                         { return time.Date(2022, 2, 3, 12, 15, 0, 0, time.UTC) }
 func (fakeClock) After(d time.Duration) <-chan time.Time { return time.After(0) }
 
+// countingClient counts the commands run by the wrapped client
+type countingClient struct {
+	BarmanClient
+	calls int32
+}
+
+func (c *countingClient) ListServer(ctx context.Context) (BarmanListServer, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return c.BarmanClient.ListServer(ctx)
+}
+
+func (c *countingClient) Check(ctx context.Context, server string) (BarmanCheck, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return c.BarmanClient.Check(ctx, server)
+}
+
+func (c *countingClient) Status(ctx context.Context, server string) (BarmanStatus, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return c.BarmanClient.Status(ctx, server)
+}
+
+func (c *countingClient) ListBackup(ctx context.Context, server string) (BarmanListBackup, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return c.BarmanClient.ListBackup(ctx, server)
+}
+
+func (c *countingClient) ShowBackup(ctx context.Context, server, id string) (BarmanShowBackup, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return c.BarmanClient.ShowBackup(ctx, server, id)
+}
+
+var testFixtureClient = FixtureClient{Dir: "tests/fixtures"}
+
+func newTestExporter(options Options) (*Exporter, *prometheus.Registry) {
+	exporter := NewExporter(testFixtureClient, options)
+	exporter.clock = fakeClock{}
+	r := prometheus.NewRegistry()
+	r.MustRegister(exporter)
+	return exporter, r
+}
+
+// metricValue returns the value of the series with the given labels
+func metricValue(t *testing.T, g prometheus.Gatherer, name string, labels prometheus.Labels) (float64, bool) {
+	families, err := g.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) != len(labels) {
+				continue
+			}
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			if metric.GetGauge() != nil {
+				return metric.GetGauge().GetValue(), true
+			}
+			return metric.GetCounter().GetValue(), true
+		}
+	}
+
+	return 0, false
+}
+
 func TestAll(t *testing.T) {
-	execCommand = fakeExecCommand
-	clock = fakeClock{}
-	assert.NoError(t, collectMetrics())
+	exporter, r := newTestExporter(DefaultOptions())
+	exporter.Refresh(context.Background())
 	testBarmanData, _ := os.Open("tests/metrics_test.txt")
-	assert.NoError(t, testutil.GatherAndCompare(prometheus.DefaultGatherer, testBarmanData,
+	assert.NoError(t, testutil.GatherAndCompare(r, testBarmanData,
 		"barman_status",
 		"barman_last_wal_age_seconds",
 		"barman_last_backup_age_seconds",
 		"barman_last_backup_size_bytes",
 		"barman_backup_duration_seconds",
 		"barman_backup_window_seconds",
+		"barman_recovery_earliest_timestamp_seconds",
+		"barman_recovery_latest_timestamp_seconds",
+		"barman_recovery_wal_continuous",
+		"barman_check_ok",
+		"barman_backups_count",
+		"barman_current_size_bytes",
+		"barman_archiver_failures",
+		"barman_archiver_last_failure_timestamp_seconds",
+		"barman_wal_archive_rate_per_hour",
+		"barman_minimum_redundancy_backups",
+		"barman_minimum_redundancy_expected",
+		"barman_active",
+		"barman_disabled",
+		"barman_passive_node",
+		"barman_in_recovery",
+		"barman_up",
+		"barman_exporter_last_collection_timestamp_seconds",
 	))
+	assert.Equal(t, 6, testutil.CollectAndCount(exporter, "barman_exporter_command_duration_seconds"))
 }
 
-func fakeExecCommand(command string, args ...string) *exec.Cmd {
-	cs := []string{"-test.run=TestHelperProcess", "--", command}
-	cs = append(cs, args...)
-	cmd := exec.Command(os.Args[0], cs...)
-	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1", "GO_FAKE_EXIT_CODE=" + strconv.Itoa(fakeExitCode)}
-	return cmd
+func TestCheckHints(t *testing.T) {
+	options := DefaultOptions()
+	options.CheckHints = true
+	exporter, r := newTestExporter(options)
+	exporter.Refresh(context.Background())
+
+	assert.Equal(t, 7, testutil.CollectAndCount(exporter, "barman_check_hint_info"))
+	value, ok := metricValue(t, r, "barman_check_hint_info", prometheus.Labels{
+		"server": "host1", "check": "failed_backups", "hint": "there are 0 failed backups",
+	})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
 }
 
-func TestHelperProcess(t *testing.T) {
-	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
-		return
+func TestBackupMetrics(t *testing.T) {
+	options := DefaultOptions()
+	options.BackupMetrics = true
+	options.MaxBackups = 2
+	exporter, r := newTestExporter(options)
+	exporter.Refresh(context.Background())
+
+	assert.Equal(t, 2, testutil.CollectAndCount(exporter, "barman_backup_size_bytes"))
+	labels := prometheus.Labels{"server": "host1", "backup_id": "20220226T070004"}
+	expected := map[string]float64{
+		"barman_backup_size_bytes":              36175268621,
+		"barman_backup_begin_timestamp_seconds": 1645840805,
+		"barman_backup_end_timestamp_seconds":   1645842241,
+		"barman_backup_copy_time_seconds":       1187.006976,
 	}
-	command := os.Args[3]
-	arguments := os.Args[6:]
-
-	switch command {
-	case "barman":
-		switch arguments[0] {
-		case "status":
-			jsonFile, err := ioutil.ReadFile("tests/status_test.json")
-			if err != nil {
-				panic(err.Error())
-			}
-			_, _ = fmt.Fprint(os.Stdout, string(jsonFile))
-		case "check":
-			jsonFile, err := ioutil.ReadFile("tests/check_test.json")
-			if err != nil {
-				panic(err.Error())
-			}
-			_, _ = fmt.Fprint(os.Stdout, string(jsonFile))
-		case "list-server":
-			jsonFile, err := ioutil.ReadFile("tests/list_server_test.json")
-			if err != nil {
-				panic(err.Error())
-			}
-			_, _ = fmt.Fprint(os.Stdout, string(jsonFile))
-		case "list-backup":
-			jsonFile, err := ioutil.ReadFile("tests/list_backup_test.json")
-			if err != nil {
-				panic(err.Error())
-			}
-			_, _ = fmt.Fprint(os.Stdout, string(jsonFile))
-		case "show-backup":
-			jsonFile, err := ioutil.ReadFile("tests/" + arguments[2] + "_show_backup_test.json")
-			if err != nil {
-				panic(err.Error())
-			}
-			_, _ = fmt.Fprint(os.Stdout, string(jsonFile))
-		default:
-			_, _ = fmt.Fprintf(os.Stderr, "Unknown barman command call")
-			os.Exit(1)
+	for name, expectedValue := range expected {
+		value, ok := metricValue(t, r, name, labels)
+		assert.True(t, ok, name)
+		assert.Equal(t, expectedValue, value, name)
+	}
+	value, _ := metricValue(t, r, "barman_backup_deduplication_ratio", labels)
+	assert.InDelta(t, 0.1973, value, 0.0001)
+	labels["retention_status"] = "VALID"
+	value, _ = metricValue(t, r, "barman_backup_retention_status", labels)
+	assert.Equal(t, float64(1), value)
+
+	options.MaxBackups = 1
+	exporter, _ = newTestExporter(options)
+	exporter.Refresh(context.Background())
+	assert.Equal(t, 1, testutil.CollectAndCount(exporter, "barman_backup_size_bytes"))
+	assert.Equal(t, 1, testutil.CollectAndCount(exporter, "barman_backup_retention_status"))
+}
+
+func TestBackupStatusMetrics(t *testing.T) {
+	jsonFile, err := ioutil.ReadFile("tests/list_backup_status_test.json")
+	assert.NoError(t, err)
+	var data BarmanListBackup
+	assert.NoError(t, json.Unmarshal(jsonFile, &data))
+
+	now := time.Date(2022, 2, 28, 17, 0, 2, 0, time.UTC)
+	backupList := data["host1"]
+	// the running backup started at 07:00:02 UTC, whatever the time zone of its id
+	shows := map[string]ShowBackupInfo{"20220228T070002": {
+		BaseBackupInformation: BaseBackupInformation{BeginTimeTimestamp: "1646031602"},
+	}}
+	r := prometheus.NewRegistry()
+	r.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		collectBackupStatusMetrics(ch, "host1", backupList, shows, now)
+	}))
+
+	status := func(status string) float64 {
+		value, _ := metricValue(t, r, "barman_backups_by_status", prometheus.Labels{"server": "host1", "status": status})
+		return value
+	}
+	assert.Equal(t, float64(2), status("DONE"))
+	assert.Equal(t, float64(1), status("FAILED"))
+	assert.Equal(t, float64(1), status("STARTED"))
+	assert.Equal(t, float64(0), status("WAITING_FOR_WALS"))
+
+	retention := func(retention string) float64 {
+		value, _ := metricValue(t, r, "barman_backups_by_retention_status",
+			prometheus.Labels{"server": "host1", "retention_status": retention})
+		return value
+	}
+	assert.Equal(t, float64(1), retention("VALID"))
+	assert.Equal(t, float64(1), retention("OBSOLETE"))
+	assert.Equal(t, float64(2), retention("NONE"))
+
+	value, ok := metricValue(t, r, "barman_running_backup_age_seconds", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(10*60*60), value)
+
+	backupList = backupList[1:]
+	_, ok = metricValue(t, r, "barman_running_backup_age_seconds", prometheus.Labels{"server": "host1"})
+	assert.False(t, ok)
+}
+
+// runningBackupClient adds a running backup to the catalog of every server
+type runningBackupClient struct {
+	BarmanClient
+}
+
+func (c runningBackupClient) ListBackup(ctx context.Context, server string) (BarmanListBackup, error) {
+	list, err := c.BarmanClient.ListBackup(ctx, server)
+	if err != nil {
+		return list, err
+	}
+	backup := BackupInfo{BackupID: "20220228T070002", Status: "STARTED"}
+	return BarmanListBackup{server: append([]BackupInfo{backup}, list[server]...)}, nil
+}
+
+func (c runningBackupClient) ShowBackup(ctx context.Context, server, id string) (BarmanShowBackup, error) {
+	if id != "20220228T070002" {
+		return c.BarmanClient.ShowBackup(ctx, server, id)
+	}
+	show := ShowBackupInfo{BackupID: id, Status: "STARTED"}
+	show.BeginTimeTimestamp = strconv.FormatInt(fakeClock{}.Now().Add(-time.Hour).Unix(), 10)
+	return BarmanShowBackup{server: show}, nil
+}
+
+func TestRunningBackupAge(t *testing.T) {
+	exporter, r := newTestExporter(DefaultOptions())
+	exporter.client = runningBackupClient{BarmanClient: testFixtureClient}
+	exporter.Refresh(context.Background())
+
+	value, ok := metricValue(t, r, "barman_running_backup_age_seconds", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(60*60), value)
+}
+
+func TestFetchServers(t *testing.T) {
+	options := DefaultOptions()
+	options.Concurrency = 2
+	exporter, _ := newTestExporter(options)
+
+	results := exporter.fetchServers(context.Background(), []string{"host3", "host1", "host2"})
+	assert.Len(t, results, 3)
+	assert.Equal(t, "host1", results[0].server)
+	assert.True(t, results[0].check.AllOk())
+	assert.Len(t, results[0].shows, 3)
+	assert.Equal(t, "host3", results[2].server)
+	assert.Nil(t, results[2].check)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	client := NewExecClient("barman", 100*time.Millisecond)
+	// the shell spawns a child holding stdout open, only killing the process group stops it
+	client.command = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		return exec.CommandContext(ctx, "sh", "-c", "sleep 10 & wait")
+	}
+	exporter := NewExporter(client, DefaultOptions())
+
+	start := time.Now()
+	_, err := exporter.client.Check(context.Background(), "host1")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, float64(1), testutil.ToFloat64(exporter.commandTimeouts.With(prometheus.Labels{"command": "check"})))
+	assert.Equal(t, float64(1), testutil.ToFloat64(exporter.commandErrors.With(prometheus.Labels{
+		"command": "check", "server": "host1", "reason": "timeout",
+	})))
+	// every call is kept in the histogram, not only the last one
+	_, _ = exporter.client.Check(context.Background(), "host1")
+	assert.Equal(t, uint64(2), histogramCount(t, exporter, "barman_exporter_command_duration_seconds"))
+}
+
+// histogramCount returns the number of observations of a histogram with a single series
+func histogramCount(t *testing.T, c prometheus.Collector, name string) uint64 {
+	r := prometheus.NewRegistry()
+	r.MustRegister(c)
+	families, err := r.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name && assert.Len(t, family.GetMetric(), 1) {
+			return family.GetMetric()[0].GetHistogram().GetSampleCount()
 		}
-	default:
-		_, _ = fmt.Fprintf(os.Stderr, "Unknown command call: %s", command)
-		os.Exit(2)
 	}
 
-	os.Exit(0)
+	return 0
+}
+
+func TestRemovedServer(t *testing.T) {
+	exporter, _ := newTestExporter(DefaultOptions())
+	exporter.servers["old"] = true
+	exporter.commandErrors.With(prometheus.Labels{"command": "check", "server": "old", "reason": "exit"}).Inc()
+	exporter.showCache["old"] = map[string]ShowBackupInfo{"20220101T000000": {}}
+
+	exporter.Refresh(context.Background())
+	assert.False(t, exporter.servers["old"])
+	assert.NotContains(t, exporter.showCache, "old")
+	assert.Equal(t, 1, testutil.CollectAndCount(exporter, "barman_status"))
+	assert.Equal(t, 1, testutil.CollectAndCount(exporter, "barman_up"))
+	assert.Equal(t, 0, exporter.commandErrors.DeletePartialMatch(prometheus.Labels{"server": "old"}))
+}
+
+func TestClearFailedData(t *testing.T) {
+	data := &serverData{server: "host4", failed: true, backups: []BackupInfo{}}
+	r := prometheus.NewRegistry()
+	r.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		data.collect(ch, fakeClock{}.Now(), DefaultOptions())
+	}))
+
+	value, ok := metricValue(t, r, "barman_up", prometheus.Labels{"server": "host4"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(0), value)
+	for _, name := range []string{"barman_last_wal_age_seconds", "barman_last_backup_age_seconds", "barman_backup_window_seconds"} {
+		_, ok = metricValue(t, r, name, prometheus.Labels{"server": "host4"})
+		assert.False(t, ok, name)
+	}
+}
+
+// hangingClient blocks list-server until the context is done
+type hangingClient struct {
+	BarmanClient
+}
+
+func (c hangingClient) ListServer(ctx context.Context) (BarmanListServer, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCollectOnScrapeTimeout(t *testing.T) {
+	options := DefaultOptions()
+	options.OnScrape = true
+	options.ScrapeTimeout = 50 * time.Millisecond
+	exporter := NewExporter(hangingClient{BarmanClient: testFixtureClient}, options)
+
+	start := time.Now()
+	testutil.CollectAndCount(exporter, "barman_up")
+	testutil.CollectAndCount(exporter, "barman_up")
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+// slowServersClient lists more servers than the concurrency, barman status hangs for the last ones
+type slowServersClient struct {
+	BarmanClient
+	hanging map[string]bool
+	lists   int32
+}
+
+func (c *slowServersClient) ListServer(_ context.Context) (BarmanListServer, error) {
+	atomic.AddInt32(&c.lists, 1)
+	return BarmanListServer{"host1": {}, "host2": {}, "host3": {}, "host4": {}, "host5": {}, "host6": {}}, nil
+}
+
+func (c *slowServersClient) Status(ctx context.Context, server string) (BarmanStatus, error) {
+	if c.hanging[server] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return c.BarmanClient.Status(ctx, server)
+}
+
+func TestCollectOnScrapePartial(t *testing.T) {
+	options := DefaultOptions()
+	options.OnScrape = true
+	options.Concurrency = 2
+	options.ScrapeTimeout = 100 * time.Millisecond
+	client := &slowServersClient{BarmanClient: testFixtureClient, hanging: map[string]bool{"host5": true, "host6": true}}
+	exporter := NewExporter(client, options)
+	r := prometheus.NewRegistry()
+	r.MustRegister(exporter)
+
+	// the servers collected before the timeout are published
+	value, ok := metricValue(t, r, "barman_up", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+	assert.Equal(t, 4, testutil.CollectAndCount(exporter, "barman_up"))
+	_, ok = metricValue(t, r, "barman_up", prometheus.Labels{"server": "host5"})
+	assert.False(t, ok)
+
+	// the collection counts for MinInterval
+	assert.Equal(t, int32(1), atomic.LoadInt32(&client.lists))
+}
+
+func TestCollectOnScrape(t *testing.T) {
+	options := DefaultOptions()
+	options.OnScrape = true
+	exporter, r := newTestExporter(options)
+	client := &countingClient{BarmanClient: testFixtureClient}
+	exporter.client = client
+
+	value, ok := metricValue(t, r, "barman_status", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+	assert.Equal(t, int32(7), atomic.LoadInt32(&client.calls))
+
+	// the cached result is used until the minimum refresh interval elapses
+	_, ok = metricValue(t, r, "barman_status", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, int32(7), atomic.LoadInt32(&client.calls))
+}
+
+func TestCheckUnknownKeys(t *testing.T) {
+	var data BarmanCheck
+	assert.NoError(t, json.Unmarshal([]byte(`{"host2": {
+		"archive_mode": {"hint": "", "status": "OK"},
+		"wal_archiving_errors": {"hint": "3 errors", "status": "FAILED"}
+	}}`), &data))
+
+	check := data["host2"]
+	assert.False(t, check.AllOk())
+	assert.Equal(t, []string{"wal_archiving_errors"}, check.Unknown())
+
+	r := prometheus.NewRegistry()
+	r.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		collectCheckMetrics(ch, "host2", check, false)
+	}))
+	value, ok := metricValue(t, r, "barman_check_ok", prometheus.Labels{"server": "host2", "check": "wal_archiving_errors"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(0), value)
+}
+
+func TestServerFilters(t *testing.T) {
+	options := DefaultOptions()
+	options.ServerInclude = regexp.MustCompile("^(?:host.*)$")
+	options.ServerExclude = regexp.MustCompile("^(?:host-test)$")
+	assert.True(t, options.included("host1"))
+	assert.False(t, options.included("host-test"))
+	assert.False(t, options.included("db1"))
+
+	options.ServerInclude = regexp.MustCompile("^(?:db.*)$")
+	exporter, _ := newTestExporter(options)
+	exporter.Refresh(context.Background())
+	assert.Equal(t, 0, testutil.CollectAndCount(exporter, "barman_up"))
+}
+
+// disabledClient reports every server as disabled
+type disabledClient struct {
+	BarmanClient
+}
+
+func (c disabledClient) Status(ctx context.Context, server string) (BarmanStatus, error) {
+	status, err := c.BarmanClient.Status(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	info := status[server]
+	info.Disabled.Message = "True"
+	status[server] = info
+	return status, nil
+}
+
+func TestSkipInactive(t *testing.T) {
+	options := DefaultOptions()
+	options.SkipInactive = true
+	exporter, r := newTestExporter(options)
+	client := &countingClient{BarmanClient: disabledClient{testFixtureClient}}
+	exporter.client = client
+	exporter.Refresh(context.Background())
+
+	// list-server and status
+	assert.Equal(t, int32(2), atomic.LoadInt32(&client.calls))
+	value, ok := metricValue(t, r, "barman_server_skipped", prometheus.Labels{"server": "host1", "reason": "disabled"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+	value, ok = metricValue(t, r, "barman_disabled", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+	assert.Equal(t, 0, testutil.CollectAndCount(exporter, "barman_status"))
+}
+
+func TestReplicationMetrics(t *testing.T) {
+	options := DefaultOptions()
+	options.Replication = true
+	exporter, r := newTestExporter(options)
+	exporter.Refresh(context.Background())
+
+	tests := []struct {
+		name   string
+		labels prometheus.Labels
+		value  float64
+	}{
+		{"barman_replication_clients", prometheus.Labels{"server": "host1", "kind": "standby"}, 1},
+		{"barman_replication_clients", prometheus.Labels{"server": "host1", "kind": "wal_streamer"}, 1},
+		{"barman_replication_lag_bytes", prometheus.Labels{"server": "host1", "application_name": "barman_receive_wal", "stage": "flush"}, 0x148},
+		{"barman_replication_lag_bytes", prometheus.Labels{"server": "host1", "application_name": "standby1", "stage": "replay"}, 0x10148},
+		{"barman_replication_lag_seconds", prometheus.Labels{"server": "host1", "application_name": "standby1", "stage": "replay"}, 1.25},
+		{"barman_replication_slot_active", prometheus.Labels{"server": "host1", "slot": "barman"}, 1},
+	}
+	for _, test := range tests {
+		value, ok := metricValue(t, r, test.name, test.labels)
+		assert.True(t, ok, test.name)
+		assert.Equal(t, test.value, value, test.name)
+	}
+	_, ok := metricValue(t, r, "barman_replication_lag_bytes", prometheus.Labels{"server": "host1", "application_name": "barman_receive_wal", "stage": "replay"})
+	assert.False(t, ok)
+}
+
+func TestNoReplicationClients(t *testing.T) {
+	var status BarmanReplicationStatus
+	err := json.Unmarshal([]byte(`{"host1": {"streaming_clients": "No streaming clients attached"}}`), &status)
+	assert.NoError(t, err)
+	assert.Empty(t, status["host1"].Clients)
+}
+
+func TestVersionInfo(t *testing.T) {
+	exporter, r := newTestExporter(DefaultOptions())
+	exporter.Refresh(context.Background())
+
+	labels := prometheus.Labels{
+		"barman_version": "2.19",
+		"python_version": "3.9.2",
+		"rsync_version":  "3.2.3",
+		"ssh_version":    "8.4p1",
+		"kernel_version": "5.10.0-11-amd64",
+	}
+	value, ok := metricValue(t, r, "barman_version_info", labels)
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+
+	// barman diagnose isn't run again before the interval elapses
+	exporter.client = FixtureClient{Dir: t.TempDir()}
+	exporter.Refresh(context.Background())
+	_, ok = metricValue(t, r, "barman_version_info", labels)
+	assert.True(t, ok)
+}
+
+func TestBuildInfo(t *testing.T) {
+	r := prometheus.NewRegistry()
+	r.MustRegister(newBuildInfo())
+	value, ok := metricValue(t, r, "barman_exporter_build_info", prometheus.Labels{
+		"version":    Version,
+		"commit":     Commit,
+		"build_time": BuildTime,
+		"goversion":  runtime.Version(),
+	})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
 }
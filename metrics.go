@@ -0,0 +1,496 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	status = prometheus.NewDesc("barman_status",
+		"1 if server passes all diagnostics", []string{"server"}, nil)
+	lastWalAge = prometheus.NewDesc("barman_last_wal_age_seconds",
+		"Time since last received wal", []string{"server"}, nil)
+	lastBackupAge = prometheus.NewDesc("barman_last_backup_age_seconds",
+		"Time since last full backup", []string{"server"}, nil)
+	lastBackupSize = prometheus.NewDesc("barman_last_backup_size_bytes",
+		"Size of last backup", []string{"server"}, nil)
+	backupDuration = prometheus.NewDesc("barman_backup_duration_seconds",
+		"Duration of last backup", []string{"server"}, nil)
+	backupWindow = prometheus.NewDesc("barman_backup_window_seconds",
+		"Time range for PITR on the current timeline", []string{"server"}, nil)
+	recoveryEarliest = prometheus.NewDesc("barman_recovery_earliest_timestamp_seconds",
+		"Earliest point in time the server can be recovered to on the timeline", []string{"server", "timeline"}, nil)
+	recoveryLatest = prometheus.NewDesc("barman_recovery_latest_timestamp_seconds",
+		"Latest point in time the server can be recovered to on the timeline", []string{"server", "timeline"}, nil)
+	recoveryWalContinuous = prometheus.NewDesc("barman_recovery_wal_continuous",
+		"1 if no WAL segment is missing between the earliest and the latest recovery points", []string{"server", "timeline"}, nil)
+	walGaps = prometheus.NewDesc("barman_wal_gaps",
+		"Number of ranges of WAL segments missing from the archive after the oldest backup", []string{"server", "timeline"}, nil)
+	walMissingSegments = prometheus.NewDesc("barman_wal_missing_segments",
+		"Number of WAL segments missing from the archive after the oldest backup", []string{"server", "timeline"}, nil)
+	walFirstMissing = prometheus.NewDesc("barman_wal_first_missing_segment",
+		"Position in the timeline of the oldest missing WAL segment", []string{"server", "timeline"}, nil)
+	walContiguousOldest = prometheus.NewDesc("barman_wal_contiguous_oldest_segment",
+		"Position in the timeline of the oldest segment of the contiguous WAL ending with the newest one", []string{"server", "timeline"}, nil)
+	walContiguousNewest = prometheus.NewDesc("barman_wal_contiguous_newest_segment",
+		"Position in the timeline of the newest archived WAL segment", []string{"server", "timeline"}, nil)
+	replicationClients = prometheus.NewDesc("barman_replication_clients",
+		"Number of clients streaming from the PostgreSQL server per kind (standby or wal_streamer)", []string{"server", "kind"}, nil)
+	replicationLagBytes = prometheus.NewDesc("barman_replication_lag_bytes",
+		"Distance between the current LSN of the server and the LSN sent, written, flushed or replayed by the client",
+		[]string{"server", "application_name", "stage"}, nil)
+	replicationLagSeconds = prometheus.NewDesc("barman_replication_lag_seconds",
+		"Time for the client to write, flush or replay the recent WAL", []string{"server", "application_name", "stage"}, nil)
+	replicationSlotActive = prometheus.NewDesc("barman_replication_slot_active",
+		"1 if a client streams using the replication slot", []string{"server", "slot"}, nil)
+	checkOk = prometheus.NewDesc("barman_check_ok",
+		"1 if the barman check passes", []string{"server", "check"}, nil)
+	checkHint = prometheus.NewDesc("barman_check_hint_info",
+		"Hint reported by barman check, always 1", []string{"server", "check", "hint"}, nil)
+	backupsCount = prometheus.NewDesc("barman_backups_count",
+		"Number of available backups", []string{"server"}, nil)
+	currentSize = prometheus.NewDesc("barman_current_size_bytes",
+		"Current data size", []string{"server"}, nil)
+	archiverFailures = prometheus.NewDesc("barman_archiver_failures",
+		"Failures of WAL archiver", []string{"server"}, nil)
+	archiverLastFailure = prometheus.NewDesc("barman_archiver_last_failure_timestamp_seconds",
+		"Time of the last WAL archiver failure", []string{"server"}, nil)
+	walArchiveRate = prometheus.NewDesc("barman_wal_archive_rate_per_hour",
+		"Server WAL archiving rate", []string{"server"}, nil)
+	redundancyBackups = prometheus.NewDesc("barman_minimum_redundancy_backups",
+		"Number of backups counted for the minimum redundancy requirement", []string{"server"}, nil)
+	redundancyExpected = prometheus.NewDesc("barman_minimum_redundancy_expected",
+		"Minimum number of backups required", []string{"server"}, nil)
+	active = prometheus.NewDesc("barman_active",
+		"1 if the server is active", []string{"server"}, nil)
+	disabled = prometheus.NewDesc("barman_disabled",
+		"1 if the server is disabled", []string{"server"}, nil)
+	passiveNode = prometheus.NewDesc("barman_passive_node",
+		"1 if the server is a passive node", []string{"server"}, nil)
+	inRecovery = prometheus.NewDesc("barman_in_recovery",
+		"1 if the PostgreSQL cluster is in recovery", []string{"server"}, nil)
+	backupSize = prometheus.NewDesc("barman_backup_size_bytes",
+		"Size of the backup", []string{"server", "backup_id"}, nil)
+	backupWalSize = prometheus.NewDesc("barman_backup_wal_size_bytes",
+		"Size of the WAL files archived after the backup", []string{"server", "backup_id"}, nil)
+	backupBegin = prometheus.NewDesc("barman_backup_begin_timestamp_seconds",
+		"Time when the backup started", []string{"server", "backup_id"}, nil)
+	backupEnd = prometheus.NewDesc("barman_backup_end_timestamp_seconds",
+		"Time when the backup finished", []string{"server", "backup_id"}, nil)
+	backupCopyTime = prometheus.NewDesc("barman_backup_copy_time_seconds",
+		"Time spent copying the backup", []string{"server", "backup_id"}, nil)
+	backupThroughput = prometheus.NewDesc("barman_backup_throughput_bytes_per_second",
+		"Copy throughput of the backup", []string{"server", "backup_id"}, nil)
+	backupIncrementalSize = prometheus.NewDesc("barman_backup_incremental_size_bytes",
+		"Size of the data copied for the backup after deduplication", []string{"server", "backup_id"}, nil)
+	backupDeduplication = prometheus.NewDesc("barman_backup_deduplication_ratio",
+		"Fraction of the backup saved by deduplication", []string{"server", "backup_id"}, nil)
+	backupRetention = prometheus.NewDesc("barman_backup_retention_status",
+		"Retention status of the backup, always 1", []string{"server", "backup_id", "retention_status"}, nil)
+	backupsByStatus = prometheus.NewDesc("barman_backups_by_status",
+		"Number of backups in the catalog per status", []string{"server", "status"}, nil)
+	backupsByRetention = prometheus.NewDesc("barman_backups_by_retention_status",
+		"Number of backups in the catalog per retention status", []string{"server", "retention_status"}, nil)
+	runningBackupAge = prometheus.NewDesc("barman_running_backup_age_seconds",
+		"Time since the oldest backup still in progress was started", []string{"server"}, nil)
+	serverInfo = prometheus.NewDesc("barman_server_info",
+		"Configuration of the server in barman.conf, always 1",
+		[]string{"server", "backup_method", "retention_policy", "retention_policy_mode", "wal_retention_policy", "archiver", "streaming_archiver"}, nil)
+	configLastBackupMaxAge = prometheus.NewDesc("barman_config_last_backup_maximum_age_seconds",
+		"Configured maximum age of the last backup", []string{"server"}, nil)
+	configLastWalMaxAge = prometheus.NewDesc("barman_config_last_wal_maximum_age_seconds",
+		"Configured maximum age of the last archived WAL", []string{"server"}, nil)
+	configMinimumRedundancy = prometheus.NewDesc("barman_config_minimum_redundancy",
+		"Configured minimum number of backups", []string{"server"}, nil)
+	configRetentionWindow = prometheus.NewDesc("barman_config_retention_recovery_window_seconds",
+		"Recovery window of the configured retention policy", []string{"server"}, nil)
+	configRetentionRedundancy = prometheus.NewDesc("barman_config_retention_redundancy",
+		"Number of backups kept by the configured retention policy", []string{"server"}, nil)
+	serverSkipped = prometheus.NewDesc("barman_server_skipped",
+		"1 if the collection of the server was skipped because it is disabled or inactive", []string{"server", "reason"}, nil)
+	up = prometheus.NewDesc("barman_up",
+		"1 if every barman command of the server succeeded in the last collection", []string{"server"}, nil)
+	backupVerified = prometheus.NewDesc("barman_backup_verified",
+		"1 if the backup passed barman check-backup and verify-backup", []string{"server", "backup_id"}, nil)
+	newestVerifiedAge = prometheus.NewDesc("barman_backup_verified_newest_age_seconds",
+		"Time since the end of the newest backup that passed the verification", []string{"server"}, nil)
+	versionInfo = prometheus.NewDesc("barman_version_info",
+		"Versions of barman and of the tools it uses reported by barman diagnose, always 1",
+		[]string{"barman_version", "python_version", "rsync_version", "ssh_version", "kernel_version"}, nil)
+	lastCollection = prometheus.NewDesc("barman_exporter_last_collection_timestamp_seconds",
+		"Time when the last collection cycle finished", nil, nil)
+	collectionDuration = prometheus.NewDesc("barman_exporter_collection_duration_seconds",
+		"Duration of the last collection cycle", nil, nil)
+)
+
+// descriptors lists every metric built from the collected data
+var descriptors = []*prometheus.Desc{
+	status, lastWalAge, lastBackupAge, lastBackupSize, backupDuration, backupWindow, recoveryEarliest,
+	recoveryLatest, recoveryWalContinuous, walGaps, walMissingSegments, walFirstMissing, walContiguousOldest,
+	walContiguousNewest, replicationClients, replicationLagBytes, replicationLagSeconds, replicationSlotActive,
+	checkOk, checkHint,
+	backupsCount, currentSize, archiverFailures, archiverLastFailure, walArchiveRate, redundancyBackups,
+	redundancyExpected, active, disabled, passiveNode, inRecovery, backupSize, backupWalSize, backupBegin,
+	backupEnd, backupCopyTime, backupThroughput, backupIncrementalSize, backupDeduplication, backupRetention,
+	backupsByStatus, backupsByRetention, runningBackupAge, serverInfo, configLastBackupMaxAge, configLastWalMaxAge,
+	configMinimumRedundancy, configRetentionWindow, configRetentionRedundancy, serverSkipped, up, backupVerified, newestVerifiedAge, versionInfo, lastCollection, collectionDuration,
+}
+
+// backupStatuses lists the statuses a barman backup can be in
+var backupStatuses = []string{"EMPTY", "STARTED", "WAITING_FOR_WALS", "SYNCING", "DONE", "FAILED"}
+
+// retentionStatuses lists the retention statuses a barman backup can be in
+var retentionStatuses = []string{"VALID", "OBSOLETE", "POTENTIALLY_OBSOLETE", "KEEP:FULL", "KEEP:STANDALONE", "NONE"}
+
+// collectorFunc exports the metrics sent by the function
+type collectorFunc func(ch chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(ch chan<- *prometheus.Desc) { prometheus.DescribeByCollect(f, ch) }
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) { f(ch) }
+
+func gauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labels ...string) {
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+}
+
+func boolGauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, value bool, labels ...string) {
+	if value {
+		gauge(ch, desc, 1, labels...)
+	} else {
+		gauge(ch, desc, 0, labels...)
+	}
+}
+
+// parsedGauge exports the message parsed by parse, the metric is skipped if it can't be parsed
+func parsedGauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, parse func(string) (float64, error), message, server string) {
+	if value, err := parse(message); err == nil {
+		gauge(ch, desc, value, server)
+	}
+}
+
+func collectCheckMetrics(ch chan<- prometheus.Metric, server string, check CheckInfo, hints bool) {
+	boolGauge(ch, status, check.AllOk(), server)
+	for name, result := range check.Checks() {
+		boolGauge(ch, checkOk, result.Ok(), server, name)
+		if hints && result.Hint != "" {
+			gauge(ch, checkHint, 1, server, name, result.Hint)
+		}
+	}
+}
+
+func collectStatusMetrics(ch chan<- prometheus.Metric, server string, info StatusInfo) {
+	parsedGauge(ch, backupsCount, func(message string) (float64, error) {
+		return strconv.ParseFloat(message, 64)
+	}, info.BackupsNumber.Message, server)
+	parsedGauge(ch, currentSize, parseSize, info.CurrentSize.Message, server)
+	parsedGauge(ch, walArchiveRate, parseRate, info.ServerArchivedWalsPerHour.Message, server)
+	parsedGauge(ch, active, parseBool, info.Active.Message, server)
+	parsedGauge(ch, disabled, parseBool, info.Disabled.Message, server)
+	parsedGauge(ch, passiveNode, parseBool, info.PassiveNode.Message, server)
+	parsedGauge(ch, inRecovery, parseRecovery, info.IsInRecovery.Message, server)
+
+	if count, lastFailure, err := parseFailedCount(info.FailedCount.Message); err == nil {
+		gauge(ch, archiverFailures, float64(count), server)
+		if lastFailure > 0 {
+			gauge(ch, archiverLastFailure, float64(lastFailure), server)
+		}
+	}
+
+	if have, expected, err := parseRedundancy(info.MinimumRedundancy.Message); err == nil {
+		gauge(ch, redundancyBackups, float64(have), server)
+		gauge(ch, redundancyExpected, float64(expected), server)
+	}
+}
+
+func collectConfigMetrics(ch chan<- prometheus.Metric, server string, config serverConfig) {
+	gauge(ch, serverInfo, 1, server, config.get("backup_method"), config.get("retention_policy"),
+		config.get("retention_policy_mode"), config.get("wal_retention_policy"), config.bool("archiver"),
+		config.bool("streaming_archiver"))
+
+	if age, err := parsePeriod(config.get("last_backup_maximum_age")); err == nil {
+		gauge(ch, configLastBackupMaxAge, age.Seconds(), server)
+	}
+	if age, err := parsePeriod(config.get("last_wal_maximum_age")); err == nil {
+		gauge(ch, configLastWalMaxAge, age.Seconds(), server)
+	}
+	parsedGauge(ch, configMinimumRedundancy, func(value string) (float64, error) {
+		return strconv.ParseFloat(value, 64)
+	}, config.get("minimum_redundancy"), server)
+
+	if window, redundancy, err := parseRetentionPolicy(config.get("retention_policy")); err == nil {
+		if window > 0 {
+			gauge(ch, configRetentionWindow, window.Seconds(), server)
+		} else {
+			gauge(ch, configRetentionRedundancy, float64(redundancy), server)
+		}
+	}
+}
+
+// lastArchivedWalTimestamp returns the time of the last archived WAL, 0 if unknown
+func lastArchivedWalTimestamp(info StatusInfo) int64 {
+	dateParts := strings.Split(info.LastArchivedWal.Message, ", at ")
+	if len(dateParts) != 2 {
+		return 0
+	}
+	timestamp := convertDateToTimestamp(dateParts[1])
+	if timestamp < 0 {
+		return 0
+	}
+
+	return timestamp
+}
+
+func collectBackupMetrics(ch chan<- prometheus.Metric, server string, backupList []BackupInfo, shows map[string]ShowBackupInfo, maxBackups int) {
+	if len(backupList) > maxBackups {
+		backupList = backupList[:maxBackups]
+	}
+
+	for _, entry := range backupList {
+		gauge(ch, backupSize, float64(entry.SizeBytes), server, entry.BackupID)
+		gauge(ch, backupWalSize, float64(entry.WalSizeBytes), server, entry.BackupID)
+
+		show, ok := shows[entry.BackupID]
+		if !ok {
+			continue
+		}
+
+		if begin, err := strconv.ParseInt(show.BeginTimeTimestamp, 10, 64); err == nil {
+			gauge(ch, backupBegin, float64(begin), server, entry.BackupID)
+		}
+		if end, err := strconv.ParseInt(show.EndTimeTimestamp, 10, 64); err == nil {
+			gauge(ch, backupEnd, float64(end), server, entry.BackupID)
+		}
+		gauge(ch, backupCopyTime, show.CopyTimeSeconds, server, entry.BackupID)
+		gauge(ch, backupThroughput, show.ThroughputBytes, server, entry.BackupID)
+		gauge(ch, backupIncrementalSize, float64(show.IncrementalSizeBytes), server, entry.BackupID)
+		if show.DiskUsageBytes > 0 && show.IncrementalSizeBytes > 0 {
+			ratio := 1 - float64(show.IncrementalSizeBytes)/float64(show.DiskUsageBytes)
+			gauge(ch, backupDeduplication, ratio, server, entry.BackupID)
+		}
+
+		retention := show.CatalogInformation.RetentionPolicy
+		if retention == "" {
+			retention = entry.RetentionStatus
+		}
+		gauge(ch, backupRetention, 1, server, entry.BackupID, retention)
+	}
+}
+
+// runningBackup reports whether the backup is in progress. The backups waiting for WALs are
+// counted as running, as they can hang when the archiver is broken.
+func runningBackup(entry BackupInfo) bool {
+	return entry.Status == "STARTED" || entry.Status == "WAITING_FOR_WALS"
+}
+
+// collectBackupStatusMetrics exports the backups per status. The start of the running backups is
+// read from their show-backup, the time in their id is in the time zone of the barman host.
+func collectBackupStatusMetrics(ch chan<- prometheus.Metric, server string, backupList []BackupInfo, shows map[string]ShowBackupInfo, now time.Time) {
+	statuses := map[string]int{}
+	for _, status := range backupStatuses {
+		statuses[status] = 0
+	}
+	retentions := map[string]int{}
+	for _, retention := range retentionStatuses {
+		retentions[retention] = 0
+	}
+
+	var oldestRunning time.Time
+	for _, entry := range backupList {
+		statuses[entry.Status]++
+
+		retention := entry.RetentionStatus
+		if retention == "" || retention == "-" {
+			retention = "NONE"
+		}
+		retentions[retention]++
+
+		if runningBackup(entry) {
+			begin, err := strconv.ParseInt(shows[entry.BackupID].BeginTimeTimestamp, 10, 64)
+			if err != nil {
+				continue
+			}
+			started := time.Unix(begin, 0)
+			if oldestRunning.IsZero() || started.Before(oldestRunning) {
+				oldestRunning = started
+			}
+		}
+	}
+
+	for status, count := range statuses {
+		gauge(ch, backupsByStatus, float64(count), server, status)
+	}
+	for retention, count := range retentions {
+		gauge(ch, backupsByRetention, float64(count), server, retention)
+	}
+	if !oldestRunning.IsZero() {
+		gauge(ch, runningBackupAge, now.Sub(oldestRunning).Seconds(), server)
+	}
+}
+
+// collect exports the metrics of the server from the data fetched during the last cycle. Metrics
+// that can't be computed from the data are skipped instead of reporting a previous value.
+func (d *serverData) collect(ch chan<- prometheus.Metric, now time.Time, options Options) {
+	server := d.server
+
+	boolGauge(ch, up, !d.failed, server)
+	if d.config != nil {
+		collectConfigMetrics(ch, server, d.config)
+	}
+	if d.err != nil {
+		return
+	}
+	if d.skipped != "" {
+		gauge(ch, serverSkipped, 1, server, d.skipped)
+		collectStatusMetrics(ch, server, *d.status)
+		return
+	}
+
+	if d.check != nil {
+		collectCheckMetrics(ch, server, d.check, options.CheckHints)
+	}
+
+	var lastWalTimestamp int64
+	var currentTimeline uint32
+	if d.status != nil {
+		collectStatusMetrics(ch, server, *d.status)
+		currentTimeline = walTimeline(*d.status)
+		lastWalTimestamp = lastArchivedWalTimestamp(*d.status)
+		if lastWalTimestamp > 0 {
+			gauge(ch, lastWalAge, float64(now.Unix()-lastWalTimestamp), server)
+		}
+	}
+
+	if d.replication != nil {
+		collectReplicationMetrics(ch, server, *d.replication, d.config.get("slot_name"))
+	}
+	collectWalScanMetrics(ch, server, d.walScans)
+
+	if d.backups == nil {
+		return
+	}
+
+	collectBackupStatusMetrics(ch, server, d.backups, d.shows, now)
+	if options.BackupMetrics {
+		collectBackupMetrics(ch, server, d.backups, d.shows, options.MaxBackups)
+	}
+
+	backupEntries := doneBackups(d.backups)
+	if len(backupEntries) == 0 {
+		return
+	}
+
+	last := backupEntries[0]
+	gauge(ch, lastBackupSize, float64(last.SizeBytes), server)
+
+	if showLast, ok := d.shows[last.BackupID]; ok {
+		backupStart, err := strconv.ParseInt(showLast.BeginTimeTimestamp, 10, 64)
+		if err == nil {
+			gauge(ch, lastBackupAge, float64(now.Unix()-backupStart), server)
+			if backupEnd, err := strconv.ParseInt(showLast.EndTimeTimestamp, 10, 64); err == nil {
+				gauge(ch, backupDuration, float64(backupEnd-backupStart), server)
+			}
+		}
+	}
+
+	collectRecoveryMetrics(ch, server, recoverability(d.backups, d.shows, currentTimeline, lastWalTimestamp), currentTimeline)
+}
+
+// collectReplicationMetrics exports the state of the streaming clients, the lag of a client is
+// only exported once when several share the same application name. The slot configured in
+// barman.conf is reported inactive when no client uses it.
+func collectReplicationMetrics(ch chan<- prometheus.Metric, server string, info ReplicationStatusInfo, configuredSlot string) {
+	current, currentErr := parseLsn(info.CurrentLsn)
+	var standbys, streamers int
+	slots := map[string]bool{}
+	if configuredSlot != "" {
+		slots[configuredSlot] = false
+	}
+	seen := map[string]bool{}
+	for _, client := range info.Clients {
+		if client.WalStreamer() {
+			streamers++
+		} else {
+			standbys++
+		}
+		if client.ReplicationSlot != "" {
+			slots[client.ReplicationSlot] = true
+		}
+
+		name := client.ApplicationName
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if currentErr == nil {
+			for stage, value := range map[string]string{"sent": client.SentLsn, "write": client.WriteLsn, "flush": client.FlushLsn, "replay": client.ReplayLsn} {
+				if lsn, err := parseLsn(value); err == nil {
+					gauge(ch, replicationLagBytes, float64(current)-float64(lsn), server, name, stage)
+				}
+			}
+		}
+		for stage, value := range map[string]string{"write": client.WriteLag, "flush": client.FlushLag, "replay": client.ReplayLag} {
+			if lag, err := parseTimedelta(value); err == nil {
+				gauge(ch, replicationLagSeconds, lag.Seconds(), server, name, stage)
+			}
+		}
+	}
+
+	gauge(ch, replicationClients, float64(standbys), server, "standby")
+	gauge(ch, replicationClients, float64(streamers), server, "wal_streamer")
+	for slot, active := range slots {
+		boolGauge(ch, replicationSlotActive, active, server, slot)
+	}
+}
+
+func collectWalScanMetrics(ch chan<- prometheus.Metric, server string, scans []walTimelineScan) {
+	for _, scan := range scans {
+		timeline := strconv.FormatUint(uint64(scan.timeline), 10)
+		gauge(ch, walGaps, float64(scan.gaps), server, timeline)
+		gauge(ch, walMissingSegments, float64(scan.missing), server, timeline)
+		if scan.gaps > 0 {
+			gauge(ch, walFirstMissing, float64(scan.firstMissing), server, timeline)
+		}
+		gauge(ch, walContiguousOldest, float64(scan.oldest), server, timeline)
+		gauge(ch, walContiguousNewest, float64(scan.newest), server, timeline)
+	}
+}
+
+// collectRecoveryMetrics exports the recovery windows, the backup window is the one of the
+// current timeline or of the newest one if the last archived WAL is unknown
+func collectRecoveryMetrics(ch chan<- prometheus.Metric, server string, windows []recoveryWindow, currentTimeline uint32) {
+	var current *recoveryWindow
+	for i, window := range windows {
+		timeline := strconv.FormatUint(uint64(window.timeline), 10)
+		gauge(ch, recoveryEarliest, float64(window.earliest), server, timeline)
+		gauge(ch, recoveryLatest, float64(window.latest), server, timeline)
+		if window.known {
+			boolGauge(ch, recoveryWalContinuous, window.continuous, server, timeline)
+		}
+		if current == nil || current.timeline != currentTimeline {
+			current = &windows[i]
+		}
+	}
+	if current != nil {
+		gauge(ch, backupWindow, float64(current.latest-current.earliest), server)
+	}
+}
@@ -0,0 +1,232 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	sizeRegexp       = regexp.MustCompile(`^([0-9.]+) ?([KMGTPEZ]i)?B$`)
+	rateRegexp       = regexp.MustCompile(`^([0-9.]+)/hour$`)
+	failedRegexp     = regexp.MustCompile(`^([0-9]+)(?: \(\S+ at (.+)\))?$`)
+	redundancyRegexp = regexp.MustCompile(`\(([0-9]+)/([0-9]+)\)$`)
+	periodRegexp     = regexp.MustCompile(`(?i)^([0-9]+)\s+(DAY|WEEK|MONTH)S?$`)
+	windowRegexp     = regexp.MustCompile(`(?i)^RECOVERY\s+WINDOW\s+OF\s+(.+)$`)
+	redundancyPolicy = regexp.MustCompile(`(?i)^REDUNDANCY\s+([0-9]+)$`)
+	lsnRegexp        = regexp.MustCompile(`^([0-9A-Fa-f]{1,8})/([0-9A-Fa-f]{1,8})`)
+	timedeltaRegexp  = regexp.MustCompile(`^(?:(-?[0-9]+) days?, )?([0-9]+):([0-9]{2}):([0-9]{2}(?:\.[0-9]+)?)$`)
+)
+
+var sizeUnits = map[string]float64{
+	"":   1,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+	"Pi": 1 << 50,
+	"Ei": 1 << 60,
+	"Zi": 1 << 70,
+}
+
+// parseSize converts a size as printed by barman (e.g. "35.7 GiB") to bytes
+func parseSize(message string) (float64, error) {
+	matches := sizeRegexp.FindStringSubmatch(strings.TrimSpace(message))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size: %q", message)
+	}
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return value * sizeUnits[matches[2]], nil
+}
+
+// parseRate converts a rate as printed by barman (e.g. "4.85/hour") to events per hour
+func parseRate(message string) (float64, error) {
+	matches := rateRegexp.FindStringSubmatch(strings.TrimSpace(message))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid rate: %q", message)
+	}
+
+	return strconv.ParseFloat(matches[1], 64)
+}
+
+// parseFailedCount parses the archiver failure count reported by barman status
+// (e.g. "880 (000000010000006A000000B8 at Mon Feb 28 02:26:30 2022)"). The returned
+// timestamp is 0 when no failure time is reported.
+func parseFailedCount(message string) (int64, int64, error) {
+	matches := failedRegexp.FindStringSubmatch(strings.TrimSpace(message))
+	if matches == nil {
+		return 0, 0, fmt.Errorf("invalid failure count: %q", message)
+	}
+	count, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if matches[2] == "" {
+		return count, 0, nil
+	}
+	timestamp := convertDateToTimestamp(matches[2])
+	if timestamp < 0 {
+		return 0, 0, fmt.Errorf("invalid failure time: %q", matches[2])
+	}
+
+	return count, timestamp, nil
+}
+
+// parseRedundancy returns the number of available and required backups from a minimum
+// redundancy message (e.g. "satisfied (3/1)")
+func parseRedundancy(message string) (int64, int64, error) {
+	matches := redundancyRegexp.FindStringSubmatch(strings.TrimSpace(message))
+	if matches == nil {
+		return 0, 0, fmt.Errorf("invalid redundancy: %q", message)
+	}
+	have, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	expected, err := strconv.ParseInt(matches[2], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return have, expected, nil
+}
+
+// parseBool converts the "True"/"False" messages of barman status to 1 or 0
+func parseBool(message string) (float64, error) {
+	value, err := strconv.ParseBool(strings.TrimSpace(message))
+	if err != nil {
+		return 0, err
+	}
+	if value {
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+// parseRecovery returns 1 if the cluster state reported by barman is "in recovery"
+func parseRecovery(message string) (float64, error) {
+	switch strings.TrimSpace(message) {
+	case "in recovery":
+		return 1, nil
+	case "in production":
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("invalid cluster state: %q", message)
+	}
+}
+
+var periodUnits = map[string]time.Duration{
+	"DAY":   24 * time.Hour,
+	"WEEK":  7 * 24 * time.Hour,
+	"MONTH": 31 * 24 * time.Hour,
+}
+
+// parsePeriod converts a period of the barman configuration (e.g. "1 WEEKS") to a duration,
+// a month counts as 31 days like barman does
+func parsePeriod(value string) (time.Duration, error) {
+	matches := periodRegexp.FindStringSubmatch(strings.TrimSpace(value))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid period: %q", value)
+	}
+	count, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(count) * periodUnits[strings.ToUpper(matches[2])], nil
+}
+
+// parseRetentionPolicy returns the recovery window or the number of backups kept by a
+// retention policy (e.g. "RECOVERY WINDOW OF 3 DAYS" or "REDUNDANCY 2"), only one is set
+func parseRetentionPolicy(value string) (time.Duration, int64, error) {
+	value = strings.TrimSpace(value)
+	if matches := windowRegexp.FindStringSubmatch(value); matches != nil {
+		window, err := parsePeriod(matches[1])
+		return window, 0, err
+	}
+	if matches := redundancyPolicy.FindStringSubmatch(value); matches != nil {
+		redundancy, err := strconv.ParseInt(matches[1], 10, 64)
+		return 0, redundancy, err
+	}
+
+	return 0, 0, fmt.Errorf("invalid retention policy: %q", value)
+}
+
+// parseConfigBool parses a boolean of the barman configuration, which accepts the same
+// values as python's configparser
+func parseConfigBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "yes", "true", "on":
+		return true, nil
+	case "0", "no", "false", "off":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean: %q", value)
+	}
+}
+
+// parseLsn converts a PostgreSQL LSN (e.g. "6B/E1000148") to a position in bytes, the text
+// printed by barman after it (e.g. " (diff: 0 B)") is ignored
+func parseLsn(value string) (uint64, error) {
+	matches := lsnRegexp.FindStringSubmatch(strings.TrimSpace(value))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid LSN: %q", value)
+	}
+	high, err := strconv.ParseUint(matches[1], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	low, err := strconv.ParseUint(matches[2], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return high<<32 | low, nil
+}
+
+// parseTimedelta converts an interval printed by python (e.g. "0:00:01.500000" or
+// "1 day, 2:00:00") to a duration
+func parseTimedelta(value string) (time.Duration, error) {
+	matches := timedeltaRegexp.FindStringSubmatch(strings.TrimSpace(value))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid interval: %q", value)
+	}
+	var days, hours, minutes int64
+	if matches[1] != "" {
+		days, _ = strconv.ParseInt(matches[1], 10, 64)
+	}
+	hours, _ = strconv.ParseInt(matches[2], 10, 64)
+	minutes, _ = strconv.ParseInt(matches[3], 10, 64)
+	seconds, err := strconv.ParseFloat(matches[4], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(days)*24*time.Hour + time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), nil
+}
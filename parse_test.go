@@ -0,0 +1,158 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]float64{
+		"35.7 GiB":  35.7 * (1 << 30),
+		"921.1 MiB": 921.1 * (1 << 20),
+		"512.0 B":   512,
+		"1.0 TiB":   1 << 40,
+	}
+	for message, expected := range tests {
+		value, err := parseSize(message)
+		assert.NoError(t, err, message)
+		assert.InDelta(t, expected, value, 1, message)
+	}
+
+	_, err := parseSize("unknown")
+	assert.Error(t, err)
+}
+
+func TestParseRate(t *testing.T) {
+	value, err := parseRate("4.85/hour")
+	assert.NoError(t, err)
+	assert.Equal(t, 4.85, value)
+
+	_, err = parseRate("4.85/day")
+	assert.Error(t, err)
+}
+
+func TestParseFailedCount(t *testing.T) {
+	count, timestamp, err := parseFailedCount("880 (000000010000006A000000B8 at Mon Feb 28 02:26:30 2022)")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(880), count)
+	assert.Equal(t, int64(1646015190), timestamp)
+
+	count, timestamp, err = parseFailedCount("0")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+	assert.Equal(t, int64(0), timestamp)
+
+	_, _, err = parseFailedCount("880 (000000010000006A000000B8 at yesterday)")
+	assert.Error(t, err)
+}
+
+func TestParseRedundancy(t *testing.T) {
+	have, expected, err := parseRedundancy("satisfied (3/1)")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), have)
+	assert.Equal(t, int64(1), expected)
+
+	have, expected, err = parseRedundancy("FAILED (0/2)")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), have)
+	assert.Equal(t, int64(2), expected)
+
+	_, _, err = parseRedundancy("satisfied")
+	assert.Error(t, err)
+}
+
+func TestParseFlags(t *testing.T) {
+	value, err := parseBool("True")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), value)
+
+	value, err = parseBool("False")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), value)
+
+	value, err = parseRecovery("in production")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), value)
+
+	value, err = parseRecovery("in recovery")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), value)
+}
+
+func TestParsePeriod(t *testing.T) {
+	tests := map[string]time.Duration{
+		"1 DAYS":   24 * time.Hour,
+		"2 weeks":  14 * 24 * time.Hour,
+		"1 MONTH":  31 * 24 * time.Hour,
+		" 3 DAYS ": 72 * time.Hour,
+	}
+	for value, expected := range tests {
+		period, err := parsePeriod(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, period, value)
+	}
+
+	_, err := parsePeriod("1 YEARS")
+	assert.Error(t, err)
+}
+
+func TestParseRetentionPolicy(t *testing.T) {
+	window, redundancy, err := parseRetentionPolicy("RECOVERY WINDOW OF 3 DAYS")
+	assert.NoError(t, err)
+	assert.Equal(t, 72*time.Hour, window)
+	assert.Equal(t, int64(0), redundancy)
+
+	window, redundancy, err = parseRetentionPolicy("REDUNDANCY 2")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), window)
+	assert.Equal(t, int64(2), redundancy)
+
+	_, _, err = parseRetentionPolicy("KEEP EVERYTHING")
+	assert.Error(t, err)
+}
+
+func TestParseLsn(t *testing.T) {
+	lsn, err := parseLsn("6B/E1000148 (diff: 0 B)")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x6BE1000148), lsn)
+
+	_, err = parseLsn("None")
+	assert.Error(t, err)
+}
+
+func TestParseTimedelta(t *testing.T) {
+	tests := map[string]time.Duration{
+		"0:00:01.500000":      1500 * time.Millisecond,
+		"1:02:03":             time.Hour + 2*time.Minute + 3*time.Second,
+		"1 day, 0:00:00":      24 * time.Hour,
+		"2 days, 0:00:00.250": 48*time.Hour + 250*time.Millisecond,
+	}
+	for value, expected := range tests {
+		duration, err := parseTimedelta(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, duration, value)
+	}
+
+	_, err := parseTimedelta("")
+	assert.Error(t, err)
+}
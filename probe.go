@@ -0,0 +1,137 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	probeSuccess = prometheus.NewDesc("barman_probe_success",
+		"1 if every barman command of the probe succeeded", nil, nil)
+	probeDuration = prometheus.NewDesc("barman_probe_duration_seconds",
+		"Duration of the probe", nil, nil)
+)
+
+// probeTargets resolves the target of a probe to a client. The remote hosts not configured are
+// only connected when newRemote is set, for the duration of the probe.
+type probeTargets struct {
+	// local is used when no target is given, nil if barman only runs on remote hosts
+	local BarmanClient
+	// newRemote creates the client of a remote host, nil to allow only the known hosts
+	newRemote func(host string) (*SSHClient, error)
+
+	mu      sync.Mutex
+	remotes map[string]*SSHClient
+}
+
+// client returns the client of the target and the function releasing it once the probe is done
+func (p *probeTargets) client(target string) (BarmanClient, func(), error) {
+	if target == "" {
+		if p.local == nil {
+			return nil, nil, fmt.Errorf("the target parameter is required")
+		}
+		return p.local, func() {}, nil
+	}
+
+	p.mu.Lock()
+	// the remote hosts are known by their barman_host label, without the user
+	client, ok := p.remotes[sshHostName(target)]
+	p.mu.Unlock()
+	if ok {
+		return client, func() {}, nil
+	}
+	if p.newRemote == nil {
+		return nil, nil, fmt.Errorf("unknown target: %s", target)
+	}
+	// the hosts not configured aren't kept, any query could add one
+	client, err := p.newRemote(target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, func() { _ = client.Close() }, nil
+}
+
+// close closes the connections of the remote hosts
+func (p *probeTargets) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, client := range p.remotes {
+		_ = client.Close()
+	}
+}
+
+// probeHandler collects the server of a target on demand, in the style of the blackbox exporter:
+// /probe?target=<host>&server=<name>. Without server every server of the target is collected.
+func probeHandler(targets *probeTargets, options Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		target := params.Get("target")
+		client, release, err := targets.client(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer release()
+
+		ctx := r.Context()
+		// leave some time to reply before prometheus gives up on the scrape
+		if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+			if seconds, err := strconv.ParseFloat(header, 64); err == nil && seconds > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(seconds*0.9*float64(time.Second)))
+				defer cancel()
+			}
+		}
+
+		probeOptions := options
+		probeOptions.OnScrape = false
+		// the versions aren't part of a probe
+		probeOptions.DiagnoseInterval = 0
+		if target != "" {
+			probeOptions = probeOptions.remote()
+		}
+
+		start := time.Now()
+		exporter := NewExporter(client, probeOptions)
+		success, err := exporter.Probe(ctx, params.Get("server"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		duration := time.Since(start)
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(exporter, collectorFunc(func(ch chan<- prometheus.Metric) {
+			boolGauge(ch, probeSuccess, success)
+			gauge(ch, probeDuration, duration.Seconds())
+		}))
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
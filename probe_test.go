@@ -0,0 +1,113 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func probe(t *testing.T, handler http.Handler, query string) (int, string) {
+	request := httptest.NewRequest(http.MethodGet, "/probe?"+query, nil)
+	request.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	body, err := ioutil.ReadAll(recorder.Body)
+	assert.NoError(t, err)
+
+	return recorder.Code, string(body)
+}
+
+func TestProbe(t *testing.T) {
+	handler := probeHandler(&probeTargets{local: testFixtureClient}, DefaultOptions())
+
+	code, body := probe(t, handler, "server=host1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "barman_probe_success 1\n")
+	assert.Contains(t, body, `barman_status{server="host1"} 1`)
+	// barman diagnose isn't run by the probes
+	assert.NotContains(t, body, "barman_version_info")
+
+	// only the servers listed by barman are collected
+	code, _ = probe(t, handler, "server=host2")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// without server every server of the target is collected
+	code, body = probe(t, handler, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "barman_probe_success 1\n")
+	assert.Contains(t, body, `barman_up{server="host1"} 1`)
+
+	// nor the servers excluded by the filters
+	options := DefaultOptions()
+	options.ServerExclude = regexp.MustCompile("^host1$")
+	code, _ = probe(t, probeHandler(&probeTargets{local: testFixtureClient}, options), "server=host1")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestProbeTargets(t *testing.T) {
+	remote := &SSHClient{name: "backup1"}
+	targets := &probeTargets{remotes: map[string]*SSHClient{"backup1": remote}}
+	handler := probeHandler(targets, DefaultOptions())
+
+	code, _ := probe(t, handler, "server=host1")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = probe(t, handler, "target=backup2&server=host1")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	client, release, err := targets.client("backup1")
+	assert.NoError(t, err)
+	assert.Equal(t, remote, client)
+	release()
+	// the target can be given as configured or as the barman_host label
+	client, release, err = targets.client("barman@backup1")
+	assert.NoError(t, err)
+	assert.Equal(t, remote, client)
+	release()
+
+	// the hosts allowed on demand are connected for a single probe
+	targets.newRemote = func(host string) (*SSHClient, error) {
+		return &SSHClient{name: host}, nil
+	}
+	client, release, err = targets.client("backup2")
+	assert.NoError(t, err)
+	assert.Equal(t, "backup2", client.(*SSHClient).Host())
+	release()
+	assert.Len(t, targets.remotes, 1)
+}
+
+func TestProbeRemoteWalGaps(t *testing.T) {
+	remote, _ := newTestSSHClient(t)
+	options := DefaultOptions()
+	options.WalGaps = true
+	// the local barman_home has no WAL archive for the servers of the remote host
+	options.BarmanHome = t.TempDir()
+	targets := &probeTargets{remotes: map[string]*SSHClient{remote.Host(): remote}}
+
+	code, body := probe(t, probeHandler(targets, options), "target="+remote.Host()+"&server=host1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "barman_probe_success 1\n")
+	assert.NotContains(t, body, "barman_wal_gaps")
+}
@@ -0,0 +1,187 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// recoveryWindow is the range of time a server can be recovered to on a timeline
+type recoveryWindow struct {
+	timeline uint32
+	// earliest is the end of the oldest backup that is not obsolete, the first consistent point
+	earliest int64
+	// latest is the last archived WAL on the current timeline, the end of the newest backup on
+	// the previous ones
+	latest int64
+	// continuous is false when WAL segments are missing after the oldest backup
+	continuous bool
+	// known is false when the details of a backup of the window are missing, the continuity of
+	// the WAL archive is then unknown
+	known bool
+}
+
+// backupEndTimestamp returns the end time of a backup, false if unknown
+func backupEndTimestamp(show ShowBackupInfo) (int64, bool) {
+	end, err := strconv.ParseInt(show.EndTimeTimestamp, 10, 64)
+	return end, err == nil && end > 0
+}
+
+// missingWals returns the number of WAL segments missing between the end of the backup and the
+// end of the next one, counted on the timeline of the backup with its segment size
+func missingWals(show ShowBackupInfo, next *ShowBackupInfo) int64 {
+	segmentSize := show.XlogSegmentSize
+	timeline, end, err := segmentNumber(show.EndWal, segmentSize)
+	if err != nil {
+		return 0
+	}
+	last := end
+	if show.WalInformation.LastAvailable != "" {
+		lastTimeline, segment, err := segmentNumber(show.WalInformation.LastAvailable, segmentSize)
+		if err != nil || lastTimeline != timeline || segment < end {
+			return 0
+		}
+		last = segment
+	}
+	// barman counts the files after end_wal up to the last one available
+	missing := int64(last-end) - int64(show.WalInformation.NoOfFiles)
+	if missing < 0 {
+		missing = 0
+	}
+	if next != nil {
+		nextTimeline, nextEnd, err := segmentNumber(next.EndWal, segmentSize)
+		if err == nil && nextTimeline == timeline && nextEnd > last {
+			missing += int64(nextEnd - last)
+		}
+	}
+
+	return missing
+}
+
+// walTimeline returns the timeline of the last archived WAL reported by barman status, 0 if unknown
+func walTimeline(info StatusInfo) uint32 {
+	name := strings.SplitN(info.LastArchivedWal.Message, ",", 2)[0]
+	timeline, _, _, err := parseWalName(strings.TrimSpace(name))
+	if err != nil {
+		return 0
+	}
+
+	return timeline
+}
+
+// recoverability computes the recovery window of every timeline with a usable backup. The
+// backups are given as listed by barman, from the newest to the oldest.
+func recoverability(backups []BackupInfo, shows map[string]ShowBackupInfo, currentTimeline uint32, lastWalTimestamp int64) []recoveryWindow {
+	done := doneBackups(backups)
+	windows := map[uint32]*recoveryWindow{}
+	for i := len(done) - 1; i >= 0; i-- {
+		show, ok := shows[done[i].BackupID]
+		if !ok {
+			// the timeline of the backup is unknown
+			for _, window := range windows {
+				window.known = false
+			}
+			continue
+		}
+		timeline := uint32(show.Timeline)
+		window := windows[timeline]
+		end, hasEnd := backupEndTimestamp(show)
+		if window == nil {
+			if done[i].RetentionStatus == "OBSOLETE" || !hasEnd {
+				continue
+			}
+			window = &recoveryWindow{timeline: timeline, earliest: end, continuous: true, known: true}
+			windows[timeline] = window
+		}
+		if hasEnd && end > window.latest {
+			window.latest = end
+		}
+
+		var next *ShowBackupInfo
+		if i > 0 {
+			if nextShow, ok := shows[done[i-1].BackupID]; ok {
+				next = &nextShow
+			} else {
+				window.known = false
+			}
+		}
+		if missingWals(show, next) > 0 {
+			window.continuous = false
+		}
+	}
+
+	if window, ok := windows[currentTimeline]; ok && lastWalTimestamp > window.latest {
+		window.latest = lastWalTimestamp
+	}
+
+	result := make([]recoveryWindow, 0, len(windows))
+	for _, window := range windows {
+		result = append(result, *window)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].timeline < result[j].timeline
+	})
+
+	return result
+}
+
+// cachedShow returns the details of a DONE backup read in a previous collection, they only
+// change when the next backup of the server is taken
+func (e *Exporter) cachedShow(server, backupID, next string) (ShowBackupInfo, bool) {
+	e.cacheMu.Lock()
+	defer e.cacheMu.Unlock()
+
+	show, ok := e.showCache[server][backupID]
+	if !ok || show.CatalogInformation.NextBackup != next {
+		return ShowBackupInfo{}, false
+	}
+
+	return show, true
+}
+
+// inherit reuses the cached details of the backups of the exporter being replaced
+func (e *Exporter) inheritShows(previous *Exporter) {
+	previous.cacheMu.Lock()
+	cache := make(map[string]map[string]ShowBackupInfo, len(previous.showCache))
+	for server, shows := range previous.showCache {
+		// the maps of the servers are replaced, never modified
+		cache[server] = shows
+	}
+	previous.cacheMu.Unlock()
+
+	e.cacheMu.Lock()
+	e.showCache = cache
+	e.cacheMu.Unlock()
+}
+
+// storeShows replaces the cached details of the backups of the server
+func (e *Exporter) storeShows(server string, shows map[string]ShowBackupInfo) {
+	e.cacheMu.Lock()
+	defer e.cacheMu.Unlock()
+
+	cache := make(map[string]ShowBackupInfo, len(shows))
+	for backupID, show := range shows {
+		if show.Status == "DONE" {
+			cache[backupID] = show
+		}
+	}
+	e.showCache[server] = cache
+}
@@ -0,0 +1,182 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testShow(id string, timeline int, end int64, endWal, lastWal string, files int) ShowBackupInfo {
+	show := ShowBackupInfo{BackupID: id, Status: "DONE"}
+	show.Timeline = timeline
+	show.EndTimeTimestamp = strconv.FormatInt(end, 10)
+	show.EndWal = endWal
+	show.WalInformation.LastAvailable = lastWal
+	show.WalInformation.NoOfFiles = files
+	return show
+}
+
+func TestRecoverability(t *testing.T) {
+	backups := []BackupInfo{
+		{BackupID: "20220104T000000", Status: "DONE"},
+		{BackupID: "20220103T000000", Status: "DONE"},
+		{BackupID: "20220102T000000", Status: "DONE"},
+		{BackupID: "20220101T000000", Status: "DONE", RetentionStatus: "OBSOLETE"},
+	}
+	shows := map[string]ShowBackupInfo{
+		"20220101T000000": testShow("20220101T000000", 1, 100, "000000010000000000000002", "000000010000000000000004", 2),
+		"20220102T000000": testShow("20220102T000000", 1, 200, "000000010000000000000004", "000000010000000000000008", 3),
+		"20220103T000000": testShow("20220103T000000", 1, 300, "000000010000000000000008", "00000001000000000000000A", 2),
+		"20220104T000000": testShow("20220104T000000", 2, 400, "00000002000000000000000B", "00000002000000000000000F", 4),
+	}
+
+	windows := recoverability(backups, shows, 2, 500)
+	assert.Equal(t, []recoveryWindow{
+		{timeline: 1, earliest: 200, latest: 300, continuous: false, known: true},
+		{timeline: 2, earliest: 400, latest: 500, continuous: true, known: true},
+	}, windows)
+
+	// the status failed, the last archived WAL is unknown
+	windows = recoverability(backups, shows, 0, 0)
+	assert.Equal(t, int64(400), windows[1].latest)
+
+	// the details of a backup couldn't be read
+	delete(shows, "20220103T000000")
+	windows = recoverability(backups, shows, 2, 500)
+	assert.False(t, windows[0].known)
+	assert.True(t, windows[1].known)
+}
+
+func TestMissingWals(t *testing.T) {
+	show := testShow("a", 1, 0, "0000000100000000000000FE", "000000010000000100000002", 4)
+	assert.Equal(t, int64(0), missingWals(show, nil))
+	next := testShow("b", 1, 0, "000000010000000100000004", "", 0)
+	assert.Equal(t, int64(2), missingWals(show, &next))
+	// the next backup is on another timeline
+	next.EndWal = "000000020000000100000004"
+	assert.Equal(t, int64(0), missingWals(show, &next))
+
+	// with 64MB segments a log only has 64 segments, the log boundary isn't a gap
+	show = testShow("c", 1, 0, "00000001000000000000003E", "000000010000000100000001", 3)
+	assert.NotEqual(t, int64(0), missingWals(show, nil))
+	show.XlogSegmentSize = 64 * 1024 * 1024
+	assert.Equal(t, int64(0), missingWals(show, nil))
+}
+
+// statusFailingClient fails every barman status
+type statusFailingClient struct {
+	BarmanClient
+}
+
+func (c statusFailingClient) Status(_ context.Context, _ string) (BarmanStatus, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestBackupWindowWithoutStatus(t *testing.T) {
+	exporter, r := newTestExporter(DefaultOptions())
+	exporter.client = statusFailingClient{BarmanClient: testFixtureClient}
+	exporter.Refresh(context.Background())
+
+	value, ok := metricValue(t, r, "barman_backup_window_seconds", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1645929164-1645755950), value)
+}
+
+func TestShowCache(t *testing.T) {
+	exporter, _ := newTestExporter(DefaultOptions())
+	client := &countingClient{BarmanClient: testFixtureClient}
+	exporter.client = client
+
+	exporter.Refresh(context.Background())
+	calls := atomic.LoadInt32(&client.calls)
+	exporter.Refresh(context.Background())
+	// the middle backup is read from the cache
+	assert.Equal(t, 2*calls-1, atomic.LoadInt32(&client.calls))
+}
+
+func TestShowCacheInherit(t *testing.T) {
+	previous, _ := newTestExporter(DefaultOptions())
+	client := &countingClient{BarmanClient: testFixtureClient}
+	previous.client = client
+	previous.Refresh(context.Background())
+	calls := atomic.LoadInt32(&client.calls)
+
+	// the exporter built by a reload starts with the cache of the previous one
+	exporter, _ := newTestExporter(DefaultOptions())
+	client = &countingClient{BarmanClient: testFixtureClient}
+	exporter.client = client
+	exporter.inheritShows(previous)
+	exporter.Refresh(context.Background())
+	assert.Equal(t, calls-1, atomic.LoadInt32(&client.calls))
+}
+
+// catalogClient lists a catalog of DONE backups taken every day
+type catalogClient struct {
+	BarmanClient
+	backups []BackupInfo
+	shows   int32
+}
+
+func newCatalogClient(count int) *catalogClient {
+	c := &catalogClient{BarmanClient: testFixtureClient}
+	for i := count - 1; i >= 0; i-- {
+		c.backups = append(c.backups, BackupInfo{
+			BackupID:         fmt.Sprintf("202201%02dT000000", i+1),
+			Status:           "DONE",
+			EndTimeTimestamp: strconv.Itoa(1640995200 + i*86400),
+		})
+	}
+	return c
+}
+
+func (c *catalogClient) ListBackup(_ context.Context, server string) (BarmanListBackup, error) {
+	return BarmanListBackup{server: c.backups}, nil
+}
+
+func (c *catalogClient) ShowBackup(_ context.Context, server, id string) (BarmanShowBackup, error) {
+	atomic.AddInt32(&c.shows, 1)
+	show := testShow(id, 1, 0, "", "", 0)
+	for i, backup := range c.backups {
+		if backup.BackupID == id && i > 0 {
+			show.CatalogInformation.NextBackup = c.backups[i-1].BackupID
+		}
+	}
+	return BarmanShowBackup{server: show}, nil
+}
+
+func TestUncachedShowsLimit(t *testing.T) {
+	exporter, _ := newTestExporter(DefaultOptions())
+	client := newCatalogClient(25)
+	exporter.client = client
+
+	// the oldest and the newest backups are always read, the others fill the cache gradually
+	for _, expected := range []int32{2 + maxUncachedShows, 2 + maxUncachedShows, 2 + 3, 2} {
+		atomic.StoreInt32(&client.shows, 0)
+		exporter.Refresh(context.Background())
+		assert.Equal(t, expected, atomic.LoadInt32(&client.shows))
+	}
+}
@@ -0,0 +1,308 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serviceState is everything built from a configuration
+type serviceState struct {
+	config    Config
+	exporters []*Exporter
+	// hosts are the barman_host labels of the exporters, empty for the local barman and the URL
+	// for the cloud catalogs
+	hosts   []string
+	targets *probeTargets
+	metrics http.Handler
+	probe   http.Handler
+	signals []chan os.Signal
+	cancel  context.CancelFunc
+	// verifying waits for the verification loops, which write the state files
+	verifying sync.WaitGroup
+}
+
+// service runs the exporters built from the configuration. A reload replaces them while the
+// web server keeps running.
+type service struct {
+	// load reads and validates the configuration
+	load func() (Config, error)
+
+	// reloadMu serializes the reloads
+	reloadMu sync.Mutex
+
+	mu    sync.RWMutex
+	state *serviceState
+}
+
+func newService(load func() (Config, error)) *service {
+	return &service{load: load}
+}
+
+// build creates the exporters of the configuration, they aren't started
+func build(config Config) (*serviceState, error) {
+	options := config.Options()
+	sshOptions := config.SSHOptions()
+	newRemote := func(host string) (*SSHClient, error) {
+		return NewSSHClient(host, config.BarmanPath, config.CommandTimeout, sshOptions)
+	}
+	targets := &probeTargets{remotes: map[string]*SSHClient{}}
+	if config.SSH.ProbeAnyHost {
+		targets.newRemote = newRemote
+	}
+
+	var cloud *CloudClient
+	if config.Cloud.URL != "" {
+		var err error
+		if cloud, err = NewCloudClient(config.CloudOptions()); err != nil {
+			return nil, fmt.Errorf("failed to configure the cloud storage: %w", err)
+		}
+	}
+
+	state := &serviceState{config: config, targets: targets}
+	r := prometheus.NewRegistry()
+	r.MustRegister(newBuildInfo())
+	// the barman hosts are told apart from the cloud catalogs by the storage label
+	local := prometheus.Registerer(r)
+	if cloud != nil {
+		local = prometheus.WrapRegistererWith(prometheus.Labels{"storage": "local"}, r)
+	}
+	if len(config.SSH.Hosts) > 0 {
+		remoteOptions := options.remote()
+		for _, host := range config.SSH.Hosts {
+			client, err := newRemote(host)
+			if err != nil {
+				targets.close()
+				return nil, fmt.Errorf("failed to configure the host %s: %w", host, err)
+			}
+			targets.remotes[client.Host()] = client
+			hostOptions := remoteOptions
+			hostOptions.VerifyStateFile = hostStateFile(options.VerifyStateFile, client.Host())
+			exporter := NewExporter(client, hostOptions)
+			if err := prometheus.WrapRegistererWith(prometheus.Labels{"barman_host": client.Host()}, local).Register(exporter); err != nil {
+				targets.close()
+				return nil, fmt.Errorf("failed to register the host %s: %w", host, err)
+			}
+			state.exporters = append(state.exporters, exporter)
+			state.hosts = append(state.hosts, client.Host())
+		}
+	} else {
+		targets.local = config.LocalClient()
+		exporter := NewExporter(targets.local, options)
+		local.MustRegister(exporter)
+		state.exporters = append(state.exporters, exporter)
+		state.hosts = append(state.hosts, "")
+	}
+	if cloud != nil {
+		cloudOptions := options.remote()
+		// barman-cloud only writes the catalogs, there is no barman to run
+		cloudOptions.Replication = false
+		cloudOptions.DiagnoseInterval = 0
+		cloudOptions.VerifyStateFile = ""
+		labels := prometheus.Labels{"storage": "cloud"}
+		if len(config.SSH.Hosts) > 0 {
+			labels["barman_host"] = ""
+		}
+		exporter := NewExporter(cloud, cloudOptions)
+		if err := prometheus.WrapRegistererWith(labels, r).Register(exporter); err != nil {
+			targets.close()
+			return nil, fmt.Errorf("failed to register the cloud storage: %w", err)
+		}
+		state.exporters = append(state.exporters, exporter)
+		state.hosts = append(state.hosts, config.Cloud.URL)
+	}
+
+	state.metrics = promhttp.HandlerFor(r, promhttp.HandlerOpts{})
+	state.probe = probeHandler(targets, options)
+
+	return state, nil
+}
+
+// hostStateFile returns the state file of a remote host, e.g. verified.backup1.json for verified.json
+func hostStateFile(path, host string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+
+	return strings.TrimSuffix(path, ext) + "." + strings.ReplaceAll(host, string(filepath.Separator), "_") + ext
+}
+
+// start runs the collection and verification loops, in on-scrape mode the collection is driven
+// by the scrapes
+func (s *serviceState) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	if s.config.VerifyInterval > 0 {
+		for _, exporter := range s.exporters {
+			s.verifying.Add(1)
+			go func(exporter *Exporter) {
+				defer s.verifying.Done()
+				exporter.RunVerify(ctx, s.config.VerifyInterval)
+			}(exporter)
+		}
+	}
+	if s.config.CollectOnScrape {
+		return
+	}
+	for _, exporter := range s.exporters {
+		signal := make(chan os.Signal, 1)
+		s.signals = append(s.signals, signal)
+		go exporter.Run(ctx, signal, s.config.Interval)
+	}
+}
+
+// inherit passes the state kept by the previous exporters of the same hosts to the new ones, so
+// a reload doesn't run the commands of their caches again
+func (s *serviceState) inherit(previous *serviceState) {
+	for i, host := range s.hosts {
+		for j, previousHost := range previous.hosts {
+			if host == previousHost {
+				s.exporters[i].inheritShows(previous.exporters[j])
+				s.exporters[i].inheritVerified(previous.exporters[j])
+				break
+			}
+		}
+	}
+}
+
+// stop cancels the running barman commands, waits for the verification loops and closes the
+// remote connections
+func (s *serviceState) stop() {
+	s.cancel()
+	s.verifying.Wait()
+	s.targets.close()
+}
+
+// Reload loads the configuration and replaces the running exporters, the current ones are kept
+// if the configuration is invalid
+func (s *service) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	config, err := s.load()
+	if err != nil {
+		return err
+	}
+	state, err := build(config)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	previous := s.state
+	s.state = state
+	s.mu.Unlock()
+
+	if previous != nil {
+		if previous.config.Listen != config.Listen || previous.config.MetricsPath != config.MetricsPath {
+			log.Printf("The listen address and the metrics path are only changed on restart")
+		}
+		if previous.config.WebConfigFile != config.WebConfigFile {
+			log.Printf("The web configuration file is only changed on restart, its content is read on every connection")
+		}
+		// the previous exporters are stopped first so their results are final and they don't
+		// write the state files of the new ones
+		previous.stop()
+		state.inherit(previous)
+	}
+	state.start()
+
+	return nil
+}
+
+// Config returns the configuration in use
+func (s *service) Config() Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.state.config
+}
+
+// Refresh asks the running exporters to collect their servers now
+func (s *service) Refresh() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, signal := range s.state.signals {
+		select {
+		case signal <- syscall.SIGUSR1:
+		default:
+			// a refresh is already pending
+		}
+	}
+}
+
+// Stop stops the running exporters
+func (s *service) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != nil {
+		s.state.stop()
+	}
+}
+
+// MetricsHandler serves the metrics of the current exporters
+func (s *service) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		handler := s.state.metrics
+		s.mu.RUnlock()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// ProbeHandler serves the probes of the current configuration
+func (s *service) ProbeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		handler := s.state.probe
+		s.mu.RUnlock()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// ReloadHandler reloads the configuration on POST requests, like the /-/reload endpoint of Prometheus
+func (s *service) ReloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.Reload(); err != nil {
+			log.Printf("Failed to reload the configuration: %v", err)
+			http.Error(w, fmt.Sprintf("failed to reload the configuration: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Configuration reloaded")
+	})
+}
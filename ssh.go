@@ -0,0 +1,238 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHOptions configures the connection to the remote barman hosts
+type SSHOptions struct {
+	// User is used when the host doesn't include one
+	User string
+	// KeyFiles are the private keys offered to the hosts
+	KeyFiles []string
+	// KnownHostsFile verifies the keys of the hosts
+	KnownHostsFile string
+	// ConnectTimeout limits the time spent establishing the connection
+	ConnectTimeout time.Duration
+}
+
+// SSHClient gets the data running the barman commands on a remote host. The connection is
+// kept open between commands and reestablished when it breaks.
+type SSHClient struct {
+	commandClient
+
+	// Path is the barman executable on the remote host
+	Path string
+	// Timeout limits the time a single barman invocation can run, 0 to disable
+	Timeout time.Duration
+
+	name    string
+	address string
+	config  *ssh.ClientConfig
+
+	mu   sync.Mutex
+	conn *ssh.Client
+}
+
+// NewSSHClient creates a client for a host given as [user@]host[:port]
+func NewSSHClient(host, path string, timeout time.Duration, options SSHOptions) (*SSHClient, error) {
+	user := options.User
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user = host[:i]
+	}
+	host = sshHostName(host)
+	address := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		address = net.JoinHostPort(host, "22")
+	}
+
+	var signers []ssh.Signer
+	for _, file := range options.KeyFiles {
+		key, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the key %s: %w", file, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	hostKeyCallback, err := knownhosts.New(options.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &SSHClient{
+		Path:    path,
+		Timeout: timeout,
+		name:    host,
+		address: address,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         options.ConnectTimeout,
+		},
+	}
+	c.commandClient = commandClient{run: c.runCommand}
+
+	return c, nil
+}
+
+// sshHostName returns the host of a [user@]host[:port] target without the user
+func sshHostName(host string) string {
+	return host[strings.LastIndex(host, "@")+1:]
+}
+
+// Host returns the remote host without the user, as used in the barman_host label
+func (c *SSHClient) Host() string {
+	return c.name
+}
+
+// connection returns the open connection or dials a new one
+func (c *SSHClient) connection() (*ssh.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	conn, err := ssh.Dial("tcp", c.address, c.config)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+
+	return conn, nil
+}
+
+// reset closes the connection if it is still the current one
+func (c *SSHClient) reset(conn *ssh.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == conn {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Close closes the connection to the host
+func (c *SSHClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+
+	return err
+}
+
+// session opens a session, redialing once if the kept connection was closed by the host
+func (c *SSHClient) session() (*ssh.Session, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := c.connection()
+		if err != nil {
+			return nil, err
+		}
+		session, err := conn.NewSession()
+		if err == nil {
+			return session, nil
+		}
+		c.reset(conn)
+		if attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// shellQuote quotes an argument for the POSIX shell of the remote host
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// runCommand runs barman on the remote host. The session is closed when the context is done,
+// which makes sshd hang up the command.
+func (c *SSHClient) runCommand(ctx context.Context, command string, args ...string) ([]byte, error) {
+	if timeout := commandTimeout(ctx, c.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	session, err := c.session()
+	if err != nil {
+		return nil, &commandError{reason: "exec", err: err}
+	}
+	defer session.Close()
+
+	words := []string{shellQuote(c.Path), "-f", "json", shellQuote(command)}
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(strings.Join(words, " "))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			if message := strings.TrimSpace(stderr.String()); message != "" {
+				err = fmt.Errorf("%w: %s", err, message)
+			}
+			var exitErr *ssh.ExitError
+			if errors.As(err, &exitErr) {
+				return nil, &commandError{reason: "exit", err: err}
+			}
+			return nil, &commandError{reason: "exec", err: err}
+		}
+		return stdout.Bytes(), nil
+	case <-ctx.Done():
+		_ = session.Signal(ssh.SIGKILL)
+		_ = session.Close()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &commandError{reason: "timeout", err: ctx.Err()}
+		}
+		return nil, &commandError{reason: "canceled", err: ctx.Err()}
+	}
+}
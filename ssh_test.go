@@ -0,0 +1,218 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer answers the barman commands with the fixtures of tests/fixtures
+type testSSHServer struct {
+	listener    net.Listener
+	hostKey     ssh.Signer
+	connections int32
+}
+
+func newTestSignerFile(t *testing.T, dir string) (ssh.Signer, string) {
+	key := mustGenerateKey(t)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "id_ecdsa")
+	assert.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+
+	return signer, path
+}
+
+func newTestSSHServer(t *testing.T, authorized ssh.PublicKey) *testSSHServer {
+	hostKey, err := ssh.NewSignerFromKey(mustGenerateKey(t))
+	assert.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "barman" && string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &testSSHServer{listener: listener, hostKey: hostKey}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, config)
+		}
+	}()
+
+	return server
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	atomic.AddInt32(&s.connections, 1)
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for request := range requests {
+				if request.Type != "exec" {
+					_ = request.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Command string }
+				if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+					_ = request.Reply(false, nil)
+					return
+				}
+				_ = request.Reply(true, nil)
+
+				var words []string
+				for _, word := range strings.Fields(payload.Command) {
+					words = append(words, strings.Trim(word, "'"))
+				}
+				status := uint32(0)
+				content, err := ioutil.ReadFile(filepath.Join("tests/fixtures", fixtureName(words[3], words[4:]...)))
+				if err != nil {
+					_, _ = channel.Stderr().Write([]byte(err.Error()))
+					status = 1
+				} else {
+					_, _ = channel.Write(content)
+				}
+				_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+		}()
+	}
+}
+
+func newTestSSHClient(t *testing.T) (*SSHClient, *testSSHServer) {
+	dir := t.TempDir()
+	signer, keyFile := newTestSignerFile(t, dir)
+	server := newTestSSHServer(t, signer.PublicKey())
+
+	knownHosts := writeKnownHosts(t, server.listener.Addr().String(), server.hostKey.PublicKey())
+	client, err := NewSSHClient(server.listener.Addr().String(), "barman", time.Minute, SSHOptions{
+		User:           "barman",
+		KeyFiles:       []string{keyFile},
+		KnownHostsFile: knownHosts,
+		ConnectTimeout: 5 * time.Second,
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client, server
+}
+
+func TestSSHClient(t *testing.T) {
+	client, server := newTestSSHClient(t)
+
+	exporter := NewExporter(client, DefaultOptions())
+	exporter.clock = fakeClock{}
+	exporter.Refresh(context.Background())
+
+	r := prometheus.NewRegistry()
+	prometheus.WrapRegistererWith(prometheus.Labels{"barman_host": client.Host()}, r).MustRegister(exporter)
+	value, ok := metricValue(t, r, "barman_status", prometheus.Labels{"server": "host1", "barman_host": client.Host()})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+	value, ok = metricValue(t, r, "barman_up", prometheus.Labels{"server": "host1", "barman_host": client.Host()})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+
+	// every command of the cycle used the same connection
+	assert.Equal(t, int32(1), atomic.LoadInt32(&server.connections))
+
+	_, err := client.Status(context.Background(), "host2")
+	assert.Equal(t, "exit", commandErrorReason(err))
+
+	// a closed connection is reestablished
+	client.mu.Lock()
+	_ = client.conn.Close()
+	client.mu.Unlock()
+	_, err = client.ListServer(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&server.connections))
+}
+
+func TestSSHUnknownHostKey(t *testing.T) {
+	client, server := newTestSSHClient(t)
+
+	other, err := ssh.NewSignerFromKey(mustGenerateKey(t))
+	assert.NoError(t, err)
+	callback, err := knownhosts.New(writeKnownHosts(t, server.listener.Addr().String(), other.PublicKey()))
+	assert.NoError(t, err)
+	client.config.HostKeyCallback = callback
+
+	_, err = client.ListServer(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&server.connections))
+}
+
+func mustGenerateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return key
+}
+
+func writeKnownHosts(t *testing.T, address string, key ssh.PublicKey) string {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, key)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(line+"\n"), 0600))
+	return path
+}
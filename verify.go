@@ -0,0 +1,302 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// backupVerification is the result of the verification of a backup, as saved in VerifyStateFile
+type backupVerification struct {
+	OK bool `json:"ok"`
+	// End is the time the backup finished, 0 if unknown
+	End int64 `json:"end"`
+	// Baseline is set for the backups already DONE when the server was first seen, they aren't
+	// verified nor exported
+	Baseline bool `json:"baseline,omitempty"`
+}
+
+// missingManifestRegexp matches the failures of barman verify-backup for the backups without a
+// backup_manifest, the ones not taken with pg_basebackup
+var missingManifestRegexp = regexp.MustCompile(`(?i)manifest.*(not found|does not exist|missing|no such file)`)
+
+// backupMode returns the mode of a backup from its backup.info (e.g. postgres or rsync-exclusive),
+// empty if barman_home isn't readable
+func (e *Exporter) backupMode(server, backupID string) string {
+	if e.options.BarmanHome == "" {
+		return ""
+	}
+	info, err := DiskClient{Home: e.options.BarmanHome}.readBackupInfo(server, backupID)
+	if err != nil {
+		return ""
+	}
+
+	return info["mode"]
+}
+
+// verifyBackup runs barman check-backup, then barman verify-backup unless the backup.info of the
+// backup shows it wasn't taken with pg_basebackup. A missing backup manifest means verify-backup
+// doesn't apply and the result is the one of check-backup. An error means the result is unknown
+// and the backup is verified again in the next run.
+func (e *Exporter) verifyBackup(ctx context.Context, server, backupID string) (bool, error) {
+	ctx = withCommandTimeout(ctx, e.options.VerifyTimeout)
+	commands := []struct {
+		name string
+		run  func(ctx context.Context, server, id string) error
+	}{
+		{"check-backup", e.client.CheckBackup},
+		{"verify-backup", e.client.VerifyBackup},
+	}
+	if mode := e.backupMode(server, backupID); mode != "" && mode != "postgres" {
+		commands = commands[:1]
+	}
+
+	for _, command := range commands {
+		err := command.run(ctx, server, backupID)
+		if err == nil {
+			continue
+		}
+		if command.name == "verify-backup" && missingManifestRegexp.MatchString(err.Error()) {
+			log.Printf("Backup %s of %s has no backup manifest, only checked with barman check-backup", backupID, server)
+			continue
+		}
+		if commandErrorReason(err) == "exit" {
+			log.Printf("Backup %s of %s failed barman %s: %v", backupID, server, command.name, err)
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// verifyServer verifies the DONE backups of the server without a result, the results of the
+// backups removed from the catalog are dropped. The backups of a server seen for the first time
+// are the baseline unless VerifyExisting is set.
+func (e *Exporter) verifyServer(ctx context.Context, server string, backups []BackupInfo) {
+	e.verifyMu.Lock()
+	previous, known := e.verified[server]
+	e.verifyMu.Unlock()
+
+	results := map[string]backupVerification{}
+	for _, entry := range doneBackups(backups) {
+		if result, ok := previous[entry.BackupID]; ok {
+			results[entry.BackupID] = result
+		} else if !known && !e.options.VerifyExisting {
+			end, _ := strconv.ParseInt(entry.EndTimeTimestamp, 10, 64)
+			results[entry.BackupID] = backupVerification{End: end, Baseline: true}
+		}
+	}
+	e.storeVerified(server, results)
+
+	for _, entry := range doneBackups(backups) {
+		if _, ok := results[entry.BackupID]; ok {
+			continue
+		}
+		ok, err := e.verifyBackup(ctx, server, entry.BackupID)
+		if errors.Is(err, errNotSupported) {
+			return
+		} else if err != nil {
+			log.Printf("Failed to verify backup %s of %s: %v", entry.BackupID, server, err)
+			continue
+		}
+		end, _ := strconv.ParseInt(entry.EndTimeTimestamp, 10, 64)
+		results[entry.BackupID] = backupVerification{OK: ok, End: end}
+		// stored after every backup as a run can take hours
+		e.storeVerified(server, results)
+	}
+}
+
+// storeVerified replaces the results of the server with a copy of results
+func (e *Exporter) storeVerified(server string, results map[string]backupVerification) {
+	stored := make(map[string]backupVerification, len(results))
+	for backupID, result := range results {
+		stored[backupID] = result
+	}
+
+	e.verifyMu.Lock()
+	defer e.verifyMu.Unlock()
+	e.verified[server] = stored
+	e.saveVerified()
+}
+
+// loadVerified reads the results saved in VerifyStateFile by a previous run, once
+func (e *Exporter) loadVerified() {
+	e.verifyMu.Lock()
+	defer e.verifyMu.Unlock()
+
+	if e.verifyLoaded || e.options.VerifyStateFile == "" {
+		return
+	}
+	e.verifyLoaded = true
+	content, err := ioutil.ReadFile(e.options.VerifyStateFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to read the verification state: %v", err)
+		return
+	}
+	verified := map[string]map[string]backupVerification{}
+	if err := json.Unmarshal(content, &verified); err != nil {
+		log.Printf("Failed to parse the verification state %s: %v", e.options.VerifyStateFile, err)
+		return
+	}
+	e.verified = verified
+}
+
+// saveVerified writes the results to VerifyStateFile, verifyMu must be held
+func (e *Exporter) saveVerified() {
+	if e.options.VerifyStateFile == "" {
+		return
+	}
+	content, err := json.Marshal(e.verified)
+	if err != nil {
+		log.Printf("Failed to encode the verification state: %v", err)
+		return
+	}
+	if err := writeStateFile(e.options.VerifyStateFile, content); err != nil {
+		log.Printf("Failed to write the verification state: %v", err)
+	}
+}
+
+// writeStateFile replaces path atomically through a temporary file of its own, so a crash never
+// leaves a truncated file and the exporters of a reload never mix their writes
+func writeStateFile(path string, content []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err = file.Write(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// inheritVerified reuses the results of the exporter being replaced by a reload
+func (e *Exporter) inheritVerified(previous *Exporter) {
+	previous.verifyMu.Lock()
+	verified := make(map[string]map[string]backupVerification, len(previous.verified))
+	for server, results := range previous.verified {
+		// the maps of the servers are replaced, never modified
+		verified[server] = results
+	}
+	previous.verifyMu.Unlock()
+
+	e.verifyMu.Lock()
+	defer e.verifyMu.Unlock()
+	e.verified = verified
+	e.verifyLoaded = true
+}
+
+// Verify verifies the new DONE backups of every server, one backup at a time. The results are
+// kept in VerifyStateFile, and across reloads, so each backup is verified once.
+func (e *Exporter) Verify(ctx context.Context) {
+	e.loadVerified()
+	serverList, err := e.client.ListServer(ctx)
+	if err != nil {
+		log.Printf("Failed to run barman list-server: %v", err)
+		return
+	}
+
+	var servers []string
+	for server := range serverList {
+		if e.options.included(server) {
+			servers = append(servers, server)
+		}
+	}
+	sort.Strings(servers)
+
+	e.verifyMu.Lock()
+	for server := range e.verified {
+		if _, ok := serverList[server]; !ok || !e.options.included(server) {
+			delete(e.verified, server)
+		}
+	}
+	e.saveVerified()
+	e.verifyMu.Unlock()
+
+	for _, server := range servers {
+		if ctx.Err() != nil {
+			return
+		}
+		backups, err := e.client.ListBackup(ctx, server)
+		if err != nil {
+			log.Printf("Failed to run barman list-backup %s: %v", server, err)
+			continue
+		}
+		e.verifyServer(ctx, server, backups[server])
+	}
+}
+
+// RunVerify verifies the new backups every interval until ctx is done
+func (e *Exporter) RunVerify(ctx context.Context, interval time.Duration) {
+	for {
+		e.Verify(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.clock.After(interval):
+		}
+	}
+}
+
+// collectVerified exports the results of the backup verifications
+func (e *Exporter) collectVerified(ch chan<- prometheus.Metric, now time.Time) {
+	e.verifyMu.Lock()
+	verified := make(map[string]map[string]backupVerification, len(e.verified))
+	for server, results := range e.verified {
+		verified[server] = results
+	}
+	e.verifyMu.Unlock()
+
+	for server, results := range verified {
+		var newest int64
+		for backupID, result := range results {
+			if result.Baseline {
+				continue
+			}
+			boolGauge(ch, backupVerified, result.OK, server, backupID)
+			if result.OK && result.End > newest {
+				newest = result.End
+			}
+		}
+		if newest > 0 {
+			gauge(ch, newestVerifiedAge, float64(now.Unix()-newest), server)
+		}
+	}
+}
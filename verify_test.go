@@ -0,0 +1,237 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// verifyClient fails the verification of a backup and counts the verifications
+type verifyClient struct {
+	BarmanClient
+	failed  string
+	checks  int
+	verifys int
+	// verifyErr is returned by every verify-backup
+	verifyErr error
+}
+
+func (c *verifyClient) CheckBackup(_ context.Context, _, id string) error {
+	c.checks++
+	if id == c.failed {
+		return &commandError{reason: "exit", err: errors.New("exit status 1")}
+	}
+	return nil
+}
+
+func (c *verifyClient) VerifyBackup(_ context.Context, _, _ string) error {
+	c.verifys++
+	return c.verifyErr
+}
+
+func TestVerify(t *testing.T) {
+	options := DefaultOptions()
+	options.VerifyExisting = true
+	exporter, r := newTestExporter(options)
+	client := &verifyClient{BarmanClient: testFixtureClient, failed: "20220225T070004"}
+	exporter.client = client
+
+	exporter.Verify(context.Background())
+	assert.Equal(t, 3, client.checks)
+	// the failed backup isn't checked with verify-backup
+	assert.Equal(t, 2, client.verifys)
+
+	for backupID, expected := range map[string]float64{"20220227T070011": 1, "20220226T070004": 1, "20220225T070004": 0} {
+		value, ok := metricValue(t, r, "barman_backup_verified", prometheus.Labels{"server": "host1", "backup_id": backupID})
+		assert.True(t, ok, backupID)
+		assert.Equal(t, expected, value, backupID)
+	}
+	value, ok := metricValue(t, r, "barman_backup_verified_newest_age_seconds", prometheus.Labels{"server": "host1"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(fakeClock{}.Now().Unix()-1645929164), value)
+
+	// every backup is verified once
+	exporter.Verify(context.Background())
+	assert.Equal(t, 3, client.checks)
+}
+
+func TestVerifyRetry(t *testing.T) {
+	options := DefaultOptions()
+	options.VerifyExisting = true
+	exporter, r := newTestExporter(options)
+	// the fixtures of check-backup are missing, the results are unknown
+	exporter.Verify(context.Background())
+	_, ok := metricValue(t, r, "barman_backup_verified", prometheus.Labels{"server": "host1", "backup_id": "20220227T070011"})
+	assert.False(t, ok)
+
+	client := &verifyClient{BarmanClient: testFixtureClient}
+	exporter.client = client
+	exporter.Verify(context.Background())
+	assert.Equal(t, 3, client.checks)
+	assert.Equal(t, 3, client.verifys)
+}
+
+func TestVerifyBackupMode(t *testing.T) {
+	options := DefaultOptions()
+	options.VerifyExisting = true
+	exporter, r := newTestExporter(options)
+	// the backup method isn't known, the backups without manifest are only checked
+	client := &verifyClient{
+		BarmanClient: testFixtureClient,
+		verifyErr:    &commandError{reason: "exit", err: errors.New("exit status 1: ERROR: backup_manifest file not found")},
+	}
+	exporter.client = client
+	exporter.Verify(context.Background())
+	assert.Equal(t, 3, client.verifys)
+	value, ok := metricValue(t, r, "barman_backup_verified", prometheus.Labels{"server": "host1", "backup_id": "20220227T070011"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+
+	// any other failure of verify-backup fails the backup
+	exporter, r = newTestExporter(options)
+	client.verifyErr = &commandError{reason: "exit", err: errors.New("exit status 1: pg_verifybackup: checksum mismatch")}
+	exporter.client = client
+	exporter.Verify(context.Background())
+	value, ok = metricValue(t, r, "barman_backup_verified", prometheus.Labels{"server": "host1", "backup_id": "20220227T070011"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(0), value)
+
+	// the backup.info of the rsync backups shows they have no manifest
+	options.BarmanHome = "tests/barman_home"
+	exporter, _ = newTestExporter(options)
+	client = &verifyClient{BarmanClient: testFixtureClient}
+	exporter.client = client
+	exporter.Verify(context.Background())
+	assert.Equal(t, 3, client.checks)
+	assert.Equal(t, 0, client.verifys)
+}
+
+// newBackupClient lists a new DONE backup of host1 once added is set
+type newBackupClient struct {
+	verifyClient
+	added bool
+}
+
+func (c *newBackupClient) ListBackup(ctx context.Context, server string) (BarmanListBackup, error) {
+	list, err := c.verifyClient.ListBackup(ctx, server)
+	if err != nil || !c.added {
+		return list, err
+	}
+	backup := BackupInfo{BackupID: "20220301T070000", Status: "DONE", EndTimeTimestamp: "1646118000"}
+	return BarmanListBackup{server: append([]BackupInfo{backup}, list[server]...)}, nil
+}
+
+func TestVerifyBaseline(t *testing.T) {
+	options := DefaultOptions()
+	options.VerifyStateFile = filepath.Join(t.TempDir(), "verified.json")
+	exporter, r := newTestExporter(options)
+	client := &newBackupClient{verifyClient: verifyClient{BarmanClient: testFixtureClient}}
+	exporter.client = client
+
+	// the backups taken before the first run aren't verified nor exported
+	exporter.Verify(context.Background())
+	assert.Equal(t, 0, client.checks)
+	_, ok := metricValue(t, r, "barman_backup_verified", prometheus.Labels{"server": "host1", "backup_id": "20220227T070011"})
+	assert.False(t, ok)
+	// the temporary files are renamed over the state file
+	files, err := ioutil.ReadDir(filepath.Dir(options.VerifyStateFile))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	client.added = true
+	exporter.Verify(context.Background())
+	assert.Equal(t, 1, client.checks)
+	value, ok := metricValue(t, r, "barman_backup_verified", prometheus.Labels{"server": "host1", "backup_id": "20220301T070000"})
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), value)
+
+	// a restart reads the results of the previous run
+	restarted, _ := newTestExporter(options)
+	restarted.client = client
+	restarted.Verify(context.Background())
+	assert.Equal(t, 1, client.checks)
+
+	// a reload passes them to the new exporter
+	options.VerifyStateFile = ""
+	reloaded, _ := newTestExporter(options)
+	reloaded.client = client
+	reloaded.inheritVerified(restarted)
+	reloaded.Verify(context.Background())
+	assert.Equal(t, 1, client.checks)
+}
+
+// blockingVerifyClient runs verify-backup until the context is canceled
+type blockingVerifyClient struct {
+	BarmanClient
+	started  chan struct{}
+	once     sync.Once
+	finished bool
+}
+
+func (c *blockingVerifyClient) CheckBackup(_ context.Context, _, _ string) error {
+	return nil
+}
+
+func (c *blockingVerifyClient) VerifyBackup(ctx context.Context, _, _ string) error {
+	c.once.Do(func() { close(c.started) })
+	<-ctx.Done()
+	c.finished = true
+	return ctx.Err()
+}
+
+func TestStopWaitsVerify(t *testing.T) {
+	options := DefaultOptions()
+	options.VerifyExisting = true
+	exporter, _ := newTestExporter(options)
+	client := &blockingVerifyClient{BarmanClient: testFixtureClient, started: make(chan struct{})}
+	exporter.client = client
+
+	config := testConfig()
+	config.CollectOnScrape = true
+	config.VerifyInterval = time.Hour
+	state := &serviceState{config: config, exporters: []*Exporter{exporter}, targets: &probeTargets{}}
+	state.start()
+	<-client.started
+
+	// a reload inherits the results once the verification loops are done
+	state.stop()
+	assert.True(t, client.finished)
+}
+
+func TestHostStateFile(t *testing.T) {
+	assert.Equal(t, "", hostStateFile("", "backup1"))
+	assert.Equal(t, "/var/lib/verified.backup1.json", hostStateFile("/var/lib/verified.json", "backup1"))
+	assert.Equal(t, "state.backup1:2222", hostStateFile("state", "backup1:2222"))
+}
+
+func TestCommandTimeoutOverride(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, time.Minute, commandTimeout(ctx, time.Minute))
+	assert.Equal(t, time.Hour, commandTimeout(withCommandTimeout(ctx, time.Hour), time.Minute))
+	assert.Equal(t, time.Duration(0), commandTimeout(withCommandTimeout(ctx, 0), time.Minute))
+}
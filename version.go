@@ -19,8 +19,11 @@
 package main
 
 import (
+	"runtime"
 	"strconv"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
@@ -51,3 +54,21 @@ func init() {
 		}
 	}
 }
+
+// newBuildInfo returns the barman_exporter_build_info metric, it is registered once per process
+// without the barman_host label
+func newBuildInfo() prometheus.Collector {
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "barman_exporter_build_info",
+		Help: "Version of the exporter and of Go it was built with, always 1",
+		ConstLabels: prometheus.Labels{
+			"version":    Version,
+			"commit":     Commit,
+			"build_time": BuildTime,
+			"goversion":  runtime.Version(),
+		},
+	})
+	info.Set(1)
+
+	return info
+}
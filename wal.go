@@ -0,0 +1,257 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultWalSegmentSize is the WAL segment size of a PostgreSQL cluster built with the defaults
+const defaultWalSegmentSize = 16 * 1024 * 1024
+
+var (
+	walSegmentRegexp = regexp.MustCompile(`^[0-9A-F]{24}$`)
+	walDirRegexp     = regexp.MustCompile(`^[0-9A-F]{16}$`)
+)
+
+// walCompressionSuffixes are the extensions the archive commands may add to the segments
+var walCompressionSuffixes = []string{".gz", ".bz2", ".xz", ".lz4", ".zst", ".snappy"}
+
+// walEntry is a line of the xlog.db index kept by barman for every archived WAL file
+type walEntry struct {
+	Name        string
+	Size        int64
+	Time        float64
+	Compression string
+}
+
+// isWalSegment returns true if the name is a WAL segment (not a history or backup label file)
+func isWalSegment(name string) bool {
+	return walSegmentRegexp.MatchString(name)
+}
+
+// parseWalName splits a WAL segment name into its timeline, log and segment parts
+func parseWalName(name string) (uint32, uint32, uint32, error) {
+	if !isWalSegment(name) {
+		return 0, 0, 0, fmt.Errorf("invalid WAL segment name: %q", name)
+	}
+	var parts [3]uint32
+	for i := range parts {
+		value, err := strconv.ParseUint(name[i*8:(i+1)*8], 16, 32)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		parts[i] = uint32(value)
+	}
+
+	return parts[0], parts[1], parts[2], nil
+}
+
+// segmentNumber returns the position of the WAL segment in its timeline
+func segmentNumber(name string, segmentSize int64) (uint32, uint64, error) {
+	timeline, log, seg, err := parseWalName(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	if segmentSize <= 0 {
+		segmentSize = defaultWalSegmentSize
+	}
+	segmentsPerLog := uint64(0x100000000 / segmentSize)
+
+	return timeline, uint64(log)*segmentsPerLog + uint64(seg), nil
+}
+
+// readXlogDB parses the xlog.db index of a server, ordered as barman writes it
+func readXlogDB(path string) ([]walEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []walEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in %s: %w", path, err)
+		}
+		timestamp, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time in %s: %w", path, err)
+		}
+		entry := walEntry{Name: fields[0], Size: size, Time: timestamp}
+		if len(fields) > 3 && fields[3] != "None" {
+			entry.Compression = fields[3]
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// walTimelineScan describes the archived segments of a timeline, the positions are the segment
+// numbers returned by segmentNumber
+type walTimelineScan struct {
+	timeline uint32
+	// gaps is the number of ranges of missing segments
+	gaps int
+	// missing is the number of missing segments
+	missing uint64
+	// firstMissing is the position of the oldest missing segment, set when gaps > 0
+	firstMissing uint64
+	// oldest and newest delimit the contiguous segments ending with the newest one
+	oldest uint64
+	newest uint64
+}
+
+// scanWals finds the missing segments of every timeline of the archive. The segments before
+// start, the first WAL of the oldest backup, aren't needed for a recovery and are ignored.
+func scanWals(names []string, segmentSize int64, start string) []walTimelineScan {
+	segments := map[uint32][]uint64{}
+	for _, name := range names {
+		if name < start {
+			continue
+		}
+		timeline, segment, err := segmentNumber(name, segmentSize)
+		if err != nil {
+			continue
+		}
+		segments[timeline] = append(segments[timeline], segment)
+	}
+
+	var scans []walTimelineScan
+	for timeline, list := range segments {
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+		scan := walTimelineScan{timeline: timeline, oldest: list[0], newest: list[0]}
+		for _, segment := range list[1:] {
+			if segment == scan.newest {
+				// listed twice
+				continue
+			}
+			if segment > scan.newest+1 {
+				if scan.gaps == 0 {
+					scan.firstMissing = scan.newest + 1
+				}
+				scan.gaps++
+				scan.missing += segment - scan.newest - 1
+				scan.oldest = segment
+			}
+			scan.newest = segment
+		}
+		scans = append(scans, scan)
+	}
+	sort.Slice(scans, func(i, j int) bool {
+		return scans[i].timeline < scans[j].timeline
+	})
+
+	return scans
+}
+
+// walSegmentName returns the name of an archived file without the compression extension, empty
+// if it isn't a WAL segment
+func walSegmentName(file string) string {
+	for _, suffix := range walCompressionSuffixes {
+		file = strings.TrimSuffix(file, suffix)
+	}
+	if !isWalSegment(file) {
+		return ""
+	}
+
+	return file
+}
+
+// listWalDir lists the segments of the wals directory of a server, used when xlog.db is missing
+func listWalDir(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() || !walDirRegexp.MatchString(entry.Name()) {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if name := walSegmentName(file.Name()); name != "" && !file.IsDir() {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// ScanWals reads the WAL archive of the server from xlog.db, or from the wals directory if the
+// index is missing, and looks for missing segments after the oldest backup
+func (d DiskClient) ScanWals(server string) ([]walTimelineScan, error) {
+	backups, err := d.readBackups(server)
+	if err != nil {
+		return nil, err
+	}
+	var start string
+	segmentSize := int64(defaultWalSegmentSize)
+	for _, info := range backups {
+		if info["status"] != "DONE" {
+			continue
+		}
+		if start == "" {
+			start = info["begin_wal"]
+		}
+		// the segment size can only change with a new cluster, the newest backup is used
+		if size := info.int64("xlog_segment_size"); size > 0 {
+			segmentSize = size
+		}
+	}
+
+	walDir := filepath.Join(d.serverDir(server), "wals")
+	var names []string
+	entries, err := readXlogDB(filepath.Join(walDir, "xlog.db"))
+	switch {
+	case err == nil:
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+	case os.IsNotExist(err):
+		if names, err = listWalDir(walDir); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	return scanWals(names, segmentSize, start), nil
+}
@@ -0,0 +1,93 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanWals(t *testing.T) {
+	names := []string{
+		"00000001000000000000000A",
+		"00000001000000000000000B",
+		"00000001000000000000000D",
+		"0000000100000000000000FF",
+		"000000010000000100000000",
+		"000000010000000100000002",
+		"000000010000000100000003",
+		"00000001.history",
+		"000000020000000100000003",
+		"000000020000000100000004",
+	}
+	scans := scanWals(names, defaultWalSegmentSize, "00000001000000000000000B")
+	assert.Equal(t, []walTimelineScan{
+		{timeline: 1, gaps: 3, missing: 243, firstMissing: 0xC, oldest: 0x102, newest: 0x103},
+		{timeline: 2, oldest: 0x103, newest: 0x104},
+	}, scans)
+
+	// with 1GB segments there are 4 segments per log file
+	scans = scanWals([]string{"000000010000000000000003", "000000010000000100000000"}, 1024*1024*1024, "")
+	assert.Equal(t, 0, scans[0].gaps)
+}
+
+func TestScanWalDir(t *testing.T) {
+	home := t.TempDir()
+	base := filepath.Join(home, "pg", "base", "20220101T000000")
+	assert.NoError(t, os.MkdirAll(base, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(base, "backup.info"),
+		[]byte("status=DONE\nbegin_wal=000000010000000000000002\nxlog_segment_size=16777216\n"), 0600))
+	walDir := filepath.Join(home, "pg", "wals", "0000000100000000")
+	assert.NoError(t, os.MkdirAll(walDir, 0755))
+	for _, name := range []string{"000000010000000000000001", "000000010000000000000002", "000000010000000000000003.gz", "000000010000000000000005", "000000010000000000000003.00000028.backup"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(walDir, name), nil, 0600))
+	}
+
+	scans, err := DiskClient{Home: home}.ScanWals("pg")
+	assert.NoError(t, err)
+	assert.Equal(t, []walTimelineScan{{timeline: 1, gaps: 1, missing: 1, firstMissing: 4, oldest: 5, newest: 5}}, scans)
+}
+
+func TestWalGapsMetrics(t *testing.T) {
+	options := DefaultOptions()
+	options.WalGaps = true
+	options.BarmanHome = "tests/barman_home"
+	exporter := NewExporter(testDiskClient, options)
+	exporter.clock = fakeClock{}
+	exporter.Refresh(context.Background())
+
+	r := prometheus.NewRegistry()
+	r.MustRegister(exporter)
+	labels := prometheus.Labels{"server": "host1", "timeline": "1"}
+	value, ok := metricValue(t, r, "barman_wal_gaps", labels)
+	assert.True(t, ok)
+	assert.Equal(t, float64(0), value)
+	value, _ = metricValue(t, r, "barman_wal_contiguous_oldest_segment", labels)
+	assert.Equal(t, float64(0x689D), value)
+	value, _ = metricValue(t, r, "barman_wal_contiguous_newest_segment", labels)
+	assert.Equal(t, float64(0x6BE0), value)
+	_, ok = metricValue(t, r, "barman_wal_first_missing_segment", labels)
+	assert.False(t, ok)
+}
@@ -0,0 +1,52 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// toolkitLogger prints the key/value logs of the exporter toolkit with the standard logger
+type toolkitLogger struct{}
+
+func (toolkitLogger) Log(keyvals ...interface{}) error {
+	pairs := make([]string, 0, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", keyvals[i], keyvals[i+1]))
+	}
+	log.Print(strings.Join(pairs, " "))
+
+	return nil
+}
+
+// serveWeb serves s on the listener. The TLS and basic authentication settings are read from
+// webConfigFile, in the format of the Prometheus exporter toolkit, on every connection.
+func serveWeb(l net.Listener, s *http.Server, webConfigFile string) error {
+	systemdSocket := false
+	return web.Serve(l, s, &web.FlagConfig{
+		WebSystemdSocket: &systemdSocket,
+		WebConfigFile:    &webConfigFile,
+	}, toolkitLogger{})
+}
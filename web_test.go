@@ -0,0 +1,185 @@
+/*
+ *
+ * Copyright 2022 codestation.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+// newTestCertificate creates a certificate signed by parent, self-signed if parent is nil
+func newTestCertificate(t *testing.T, name string, parent *testCertificate, usage x509.ExtKeyUsage) *testCertificate {
+	key := mustGenerateKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return &testCertificate{cert: cert, key: key, pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+func (c *testCertificate) write(t *testing.T, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	der, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+
+	return certFile, keyFile
+}
+
+func startTestWebServer(t *testing.T, webConfig string) string {
+	dir := t.TempDir()
+	webConfigFile := filepath.Join(dir, "web-config.yml")
+	assert.NoError(t, ioutil.WriteFile(webConfigFile, []byte(webConfig), 0600))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "barman_up 1")
+	})}
+	go func() { _ = serveWeb(listener, server, webConfigFile) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	return listener.Addr().String()
+}
+
+func TestWebTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil, x509.ExtKeyUsageAny)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCertificate(t, "127.0.0.1", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+	clientCert := newTestCertificate(t, "prometheus", ca, x509.ExtKeyUsageClientAuth)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	address := startTestWebServer(t, fmt.Sprintf(`tls_server_config:
+  cert_file: %s
+  key_file: %s
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: %s
+basic_auth_users:
+  prometheus: %s
+`, certFile, keyFile, caFile, hash))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certificates []tls.Certificate, user, password string) (int, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certificates,
+		}}}
+		request, err := http.NewRequest(http.MethodGet, "https://"+address+"/metrics", nil)
+		assert.NoError(t, err)
+		if user != "" {
+			request.SetBasicAuth(user, password)
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return 0, err
+		}
+		defer response.Body.Close()
+		return response.StatusCode, nil
+	}
+
+	code, err := get([]tls.Certificate{clientCert.pair}, "prometheus", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, err = get([]tls.Certificate{clientCert.pair}, "prometheus", "wrong")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// the client certificate is required
+	_, err = get(nil, "prometheus", "secret")
+	assert.Error(t, err)
+
+	// plain HTTP is refused
+	response, err := http.Get("http://" + address + "/metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	_ = response.Body.Close()
+}
+
+func TestWebBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	address := startTestWebServer(t, fmt.Sprintf("basic_auth_users:\n  prometheus: %s\n", hash))
+
+	response, err := http.Get("http://" + address + "/metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	_ = response.Body.Close()
+
+	request, err := http.NewRequest(http.MethodGet, "http://"+address+"/metrics", nil)
+	assert.NoError(t, err)
+	request.SetBasicAuth("prometheus", "secret")
+	response, err = http.DefaultClient.Do(request)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	_ = response.Body.Close()
+}
+
+func TestInvalidWebConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "web-config.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("tls_server_config:\n  cert_file: missing.crt\n"), 0600))
+
+	config := testConfig()
+	config.WebConfigFile = path
+	assert.Error(t, config.Validate())
+}